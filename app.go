@@ -1,9 +1,17 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"bitbucket.org/ulfurinn/cli/flags"
 )
 
 type App struct {
@@ -12,34 +20,212 @@ type App struct {
 	Name                  string
 	Usage                 string
 	Main                  Command
+	In                    io.Reader
 	Out                   io.Writer
+	Err                   io.Writer
+	// Getenv looks up environment variables for option defaults and the library's own settings; os.Getenv if nil.
+	Getenv func(string) string
+	// Args are the process arguments for RunMain, starting with the program name; os.Args if nil.
+	Args []string
+	// Exit ends the process after RunMain; os.Exit if nil.
+	Exit func(int)
+	// RepeatPolicy applies to single-valued options that do not declare their own.
+	RepeatPolicy flags.RepeatPolicy
+	// CollectErrors reports all parse and validation errors together as flags.Errors
+	// instead of stopping at the first one.
+	CollectErrors bool
+	// Middleware wraps the actions of all commands, including the built-in help.
+	Middleware []Middleware
+	// RecoverPanics turns panics in Before, After and actions into a PanicError.
+	RecoverPanics bool
+	// Debug makes RunMain print the stack trace of a recovered panic; so does setting $_CLI_DEBUG.
+	Debug bool
+	// ExitCode maps the error returned from Run to the exit status of RunMain; DefaultExitCode if nil.
+	ExitCode func(error) int
+	// FormatError renders the error returned from Run for RunMain to print to Err;
+	// if nil, usage errors are followed by the command line with the offending
+	// arguments marked and by a hint, and messages are coloured on terminals.
+	FormatError func(*App, error) string
+	// GracePeriod bounds the context of After hooks once the command has been cancelled;
+	// DefaultGracePeriod if zero.
+	GracePeriod time.Duration
 }
 
+// DefaultGracePeriod is the time After hooks get to clean up after cancellation.
+const DefaultGracePeriod = 5 * time.Second
+
 func NewApp() *App {
 	return &App{
 		Name: os.Args[0],
+		In:   os.Stdin,
 		Out:  os.Stdout,
+		Err:  os.Stderr,
 	}
 }
 
 func (a *App) Run(arguments []string) error {
-	a.Main.appendHelp()
+	return a.RunContext(context.Background(), arguments)
+}
+
+// RunContext runs the application with a context available to hooks and actions through Context.Context.
+// The App and its command tree are not modified, so it can be run repeatedly and from several
+// goroutines at once, provided that options bound to a Var are not shared between concurrent runs.
+func (a *App) RunContext(parent context.Context, arguments []string) error {
+	main := a.Main
+	main.appendHelp()
 	ctx := &Context{
+		ctx:  parent,
 		app:  a,
+		argv: arguments,
 		args: arguments,
 	}
-	a.Main.FindCommand(ctx)
+	main.FindCommand(ctx)
 	return ctx.run()
 }
 
+// Validate checks the command tree for declarations that would fail or misbehave at run time:
+// duplicate subcommand names, options declared more than once along a command path,
+// and required positionals following optional ones. All problems are reported together as flags.Errors.
+func (a *App) Validate() error {
+	var errs flags.Errors
+	main := a.Main
+	main.appendHelp()
+	builtin := []Option{HelpOption}
+	if a.EnableShellCompletion {
+		builtin = append(builtin, ShellCompletionOption)
+	}
+	declared := map[string]string{}
+	for _, opt := range builtin {
+		eachName(opt.name(), func(name string) {
+			declared[name] = builtinOwner
+		})
+	}
+	main.validateTree(a.Name, declared, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// AssertValid fails the test if the command tree of the app does not pass Validate;
+// t is usually a *testing.T.
+func AssertValid(t interface {
+	Helper()
+	Fatal(...interface{})
+}, app *App) {
+	t.Helper()
+	if err := app.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Use adds middleware wrapping the actions of all commands.
+func (a *App) Use(middleware ...Middleware) {
+	a.Middleware = append(a.Middleware, middleware...)
+}
+
+func (a *App) debug() bool {
+	debug, _ := strconv.ParseBool(a.getenv("_CLI_DEBUG"))
+	return a.Debug || debug
+}
+
+// RunMain runs the application with the process arguments and exits.
+// The context is cancelled on SIGINT or SIGTERM, making a command that fails
+// with context.Canceled exit with ExitInterrupted; a second signal exits immediately.
 func (a *App) RunMain() {
-	if err := a.Run(os.Args[1:]); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		if exit, ok := err.(Exit); ok {
-			os.Exit(exit.StatusCode)
-		} else {
-			os.Exit(1)
+	ctx, stop := a.interruptContext()
+	args := a.Args
+	if args == nil {
+		args = os.Args
+	}
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	err := a.RunContext(ctx, args)
+	stop()
+	if errors.Is(err, context.Canceled) && errors.Is(context.Cause(ctx), ErrInterrupted) {
+		err = ErrInterrupted
+	}
+	if err != nil {
+		if msg := a.formatError(err); msg != "" {
+			fmt.Fprintln(a.errWriter(), msg)
 		}
 	}
-	os.Exit(0)
+	a.exit(a.exitCode(err))
+}
+
+func (a *App) exit(code int) {
+	if a.Exit != nil {
+		a.Exit(code)
+		return
+	}
+	os.Exit(code)
+}
+
+// interruptContext returns a context cancelled with ErrInterrupted on the first
+// SIGINT or SIGTERM; the second one exits the process with ExitInterrupted.
+func (a *App) interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel(ErrInterrupted)
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			a.exit(ExitInterrupted)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+func (a *App) gracePeriod() time.Duration {
+	if a.GracePeriod > 0 {
+		return a.GracePeriod
+	}
+	return DefaultGracePeriod
+}
+
+func (a *App) formatError(err error) string {
+	if a.FormatError != nil {
+		return a.FormatError(a, err)
+	}
+	return ErrorFormat{Hint: true, Color: true, CommandLine: true}.Format(a, err)
+}
+
+func (a *App) getenv(key string) string {
+	if a.Getenv != nil {
+		return a.Getenv(key)
+	}
+	return os.Getenv(key)
+}
+
+func (a *App) outWriter() io.Writer {
+	if a.Out == nil {
+		return os.Stdout
+	}
+	return a.Out
+}
+
+func (a *App) errWriter() io.Writer {
+	if a.Err == nil {
+		return os.Stderr
+	}
+	return a.Err
+}
+
+func (a *App) exitCode(err error) int {
+	if a.ExitCode != nil {
+		return a.ExitCode(err)
+	}
+	return DefaultExitCode(err)
 }
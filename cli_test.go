@@ -2,10 +2,17 @@ package cli_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	. "bitbucket.org/ulfurinn/cli"
+	"bitbucket.org/ulfurinn/cli/flags"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -39,6 +46,798 @@ func TestApp(t *testing.T) {
 			app.Run([]string{"testcmd", "sub"})
 			So(run, ShouldBeTrue)
 		})
+		Convey("Options along the command path", func() {
+			var env, target string
+			var verbose bool
+			var occ []Occurrence
+			app.Main = Command{
+				Options: []Option{
+					BoolOption{Name: "verbose"},
+					StringOption{Name: "env"},
+					StringOption{Name: "only-here", Local: true},
+				},
+				Commands: []Command{{
+					Name: "deploy",
+					Args: []Option{StringOption{Name: "target", Optional: true}},
+					Commands: []Command{{
+						Name: "now",
+						Action: func(ctx *Context) error {
+							env = ctx.String("env")
+							target = ctx.String("target")
+							verbose = ctx.Bool("verbose")
+							occ = ctx.Occurrences()
+							return nil
+						},
+					}},
+					Action: func(ctx *Context) error {
+						env = ctx.String("env")
+						target = ctx.String("target")
+						verbose = ctx.Bool("verbose")
+						return nil
+					},
+				}, {
+					Name: "now",
+				}},
+			}
+			Convey("Before the subcommand name", func() {
+				err := app.Run([]string{"--verbose", "deploy", "prod"})
+				So(err, ShouldBeNil)
+				So(verbose, ShouldBeTrue)
+				So(target, ShouldEqual, "prod")
+			})
+			Convey("Between subcommand names", func() {
+				err := app.Run([]string{"deploy", "--env", "staging", "now", "--verbose"})
+				So(err, ShouldBeNil)
+				So(env, ShouldEqual, "staging")
+				So(verbose, ShouldBeTrue)
+				So(len(occ), ShouldEqual, 2)
+				So(occ[0].Index, ShouldEqual, 1)
+				So(occ[1].Index, ShouldEqual, 4)
+			})
+			Convey("Option values are not subcommand names", func() {
+				err := app.Run([]string{"--env", "deploy", "deploy", "prod"})
+				So(err, ShouldBeNil)
+				So(env, ShouldEqual, "deploy")
+				So(target, ShouldEqual, "prod")
+			})
+			Convey("Local options stay at their level", func() {
+				err := app.Run([]string{"deploy", "--only-here", "x", "prod"})
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Not after --", func() {
+				app.Out = &bytes.Buffer{}
+				err := app.Run([]string{"--", "deploy"})
+				So(err, ShouldBeNil)
+				So(target, ShouldEqual, "")
+			})
+		})
+		Convey("Positionals on intermediate commands", func() {
+			var project, target string
+			ran := ""
+			app.Main = Command{
+				Commands: []Command{{
+					Name: "project",
+					Args: []Option{StringOption{Name: "name", Optional: true}},
+					Action: func(ctx *Context) error {
+						ran, project = "project", ctx.String("name")
+						return nil
+					},
+					Commands: []Command{{
+						Name: "build",
+						Args: []Option{StringOption{Name: "target", Optional: true}},
+						Action: func(ctx *Context) error {
+							ran, project, target = "build", ctx.String("name"), ctx.String("target")
+							return nil
+						},
+					}},
+				}},
+			}
+			Convey("Taken before the subcommand", func() {
+				err := app.Run([]string{"project", "web", "build", "release"})
+				So(err, ShouldBeNil)
+				So(ran, ShouldEqual, "build")
+				So(project, ShouldEqual, "web")
+				So(target, ShouldEqual, "release")
+			})
+			Convey("Taken by the command itself", func() {
+				err := app.Run([]string{"project", "web"})
+				So(err, ShouldBeNil)
+				So(ran, ShouldEqual, "project")
+				So(project, ShouldEqual, "web")
+			})
+			Convey("Omitted optional positionals", func() {
+				err := app.Run([]string{"project", "build", "release"})
+				So(err, ShouldBeNil)
+				So(ran, ShouldEqual, "build")
+				So(project, ShouldEqual, "")
+				So(target, ShouldEqual, "release")
+			})
+			Convey("Omitted required positionals", func() {
+				app.Main.Commands[0].Args = []Option{StringOption{Name: "name"}}
+				err := app.Run([]string{"project", "build"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "testapp project build: no value provided for argument name")
+				So(ran, ShouldEqual, "")
+				err = app.Run([]string{"project", "web", "build"})
+				So(err, ShouldBeNil)
+				So(project, ShouldEqual, "web")
+			})
+			Convey("Shown in help", func() {
+				var b bytes.Buffer
+				app.Out = &b
+				app.Run([]string{"help", "project", "build"})
+				So(b.String(), ShouldStartWith, "\nUsage: testapp project <name> build <target>\n")
+			})
+			Convey("Shown in help by their first name", func() {
+				var b bytes.Buffer
+				app.Out = &b
+				app.Main.Commands[0].Args = []Option{StringOption{Name: "name, n", Optional: true}}
+				app.Run([]string{"help", "project", "build"})
+				So(b.String(), ShouldStartWith, "\nUsage: testapp project <name> build <target>\n")
+			})
+		})
+		Convey("Positionals on the root command", func() {
+			var b bytes.Buffer
+			app.Out = &b
+			app.Main = Command{
+				Args:   []Option{StringOption{Name: "name"}},
+				Action: func(ctx *Context) error { return nil },
+			}
+			err := app.Run([]string{"help"})
+			So(err, ShouldBeNil)
+			So(b.String(), ShouldStartWith, "\nUsage: testapp <name>\n")
+		})
+		Convey("Argument counts", func() {
+			app.Main.Commands = []Command{{
+				Name:     "copy",
+				ArgCount: ExactArgs(2),
+				Action:   func(ctx *Context) error { return nil },
+			}, {
+				Name:     "rm",
+				ArgCount: MinArgs(1),
+				Action:   func(ctx *Context) error { return nil },
+			}, {
+				Name:     "ls",
+				ArgCount: RangeArgs(0, 2),
+				Action:   func(ctx *Context) error { return nil },
+			}, {
+				Name:     "status",
+				ArgCount: NoArgs(),
+				Action:   func(ctx *Context) error { return nil },
+			}}
+			Convey("Satisfied", func() {
+				So(app.Run([]string{"copy", "a", "b"}), ShouldBeNil)
+				So(app.Run([]string{"rm", "a", "b", "c"}), ShouldBeNil)
+				So(app.Run([]string{"ls"}), ShouldBeNil)
+				So(app.Run([]string{"status"}), ShouldBeNil)
+			})
+			Convey("Violated", func() {
+				err := app.Run([]string{"copy", "a"})
+				So(err, ShouldHaveSameTypeAs, UsageError{})
+				So(err.Error(), ShouldEqual, "testapp copy: expected exactly 2 arguments, got 1")
+				So(app.Run([]string{"rm"}).Error(), ShouldEqual, "testapp rm: expected at least 1 argument, got 0")
+				So(app.Run([]string{"ls", "a", "b", "c"}).Error(), ShouldEqual, "testapp ls: expected at most 2 arguments, got 3")
+				So(app.Run([]string{"status", "a"}).Error(), ShouldEqual, "testapp status: accepts no arguments, got 1")
+			})
+			Convey("Shown in help", func() {
+				var b bytes.Buffer
+				app.Out = &b
+				app.Run([]string{"help", "rm"})
+				So(b.String(), ShouldStartWith, "\nUsage: testapp rm <arg>...\n")
+				b.Reset()
+				app.Run([]string{"help", "ls"})
+				So(b.String(), ShouldStartWith, "\nUsage: testapp ls [<arg>] [<arg>]\n")
+			})
+		})
+		Convey("Collecting errors", func() {
+			app.CollectErrors = true
+			app.Main.Commands = []Command{{
+				Name:     "copy",
+				ArgCount: ExactArgs(2),
+				Options: []Option{
+					IntOption{Name: "int"},
+					StringOption{
+						Name:       "mode",
+						ValueList:  []string{"fast", "safe"},
+						Validation: ValueListValidation,
+					},
+				},
+				Action: func(ctx *Context) error { return nil },
+			}}
+			err := app.Run([]string{"copy", "--int", "x", "--mode", "slow", "--bad", "a"})
+			So(err, ShouldNotBeNil)
+			var errs flags.Errors
+			So(errors.As(err, &errs), ShouldBeTrue)
+			So(len(errs), ShouldEqual, 4)
+			var usage UsageError
+			So(errors.As(err, &usage), ShouldBeTrue)
+			So(usage.Command, ShouldEqual, "testapp copy")
+			So(DefaultExitCode(err), ShouldEqual, 2)
+			So(err.Error(), ShouldStartWith, "testapp copy: 4 errors:\n  - invalid value \"x\" for argument --int")
+		})
+		Convey("Validation", func() {
+			app.Main.Commands = []Command{{
+				Name: "scale",
+				Options: []Option{
+					IntOption{Name: "replicas", Value: 1, Validation: RangeValidation(1, 10)},
+					Float64Option{Name: "ratio", Validation: MaxValidation(1)},
+					StringOption{Name: "name", Validation: PatternValidation(`^[a-z]+$`)},
+					StringSliceOption{Name: "zone", Validation: OneOfValidation("a", "b")},
+					BoolOption{Name: "force", Validation: func(ctx *Context, opt Option) error {
+						if ctx.Bool("force") && ctx.Int("replicas") > 5 {
+							return errors.New("refusing to force more than 5 replicas")
+						}
+						return nil
+					}},
+				},
+				Args: []Option{
+					StringOption{Name: "cluster", Validation: NonEmptyValidation},
+				},
+				Action: func(ctx *Context) error { return nil },
+			}}
+			Convey("Passing", func() {
+				So(app.Run([]string{"scale", "--replicas", "3", "--zone", "a", "--name", "web", "main"}), ShouldBeNil)
+			})
+			Convey("Defaults pass", func() {
+				So(app.Run([]string{"scale", "main"}), ShouldBeNil)
+			})
+			Convey("Environment values", func() {
+				app.Main.Commands[0].Options = append(app.Main.Commands[0].Options,
+					StringOption{Name: "region", EnvVar: "REGION", Validation: OneOfValidation("eu", "us")})
+				app.Getenv = func(string) string { return "bogus" }
+				err := app.Run([]string{"scale", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp scale: invalid value "bogus" for --region: must be one of eu, us`)
+			})
+			Convey("Environment integers", func() {
+				var offset int
+				app.Main.Commands[0].Options = append(app.Main.Commands[0].Options,
+					IntOption{Name: "offset", Value: 20, EnvVar: "OFF", Validation: RangeValidation(-5, 10)})
+				app.Main.Commands[0].Action = func(ctx *Context) error {
+					offset = ctx.Int("offset")
+					return nil
+				}
+				Convey("Negative values apply", func() {
+					app.Getenv = func(string) string { return "-3" }
+					So(app.Run([]string{"scale", "main"}), ShouldBeNil)
+					So(offset, ShouldEqual, -3)
+				})
+				Convey("Unparsable values leave the default", func() {
+					app.Getenv = func(string) string { return "bogus" }
+					So(app.Run([]string{"scale", "main"}), ShouldBeNil)
+					So(offset, ShouldEqual, 20)
+				})
+			})
+			Convey("Range", func() {
+				err := app.Run([]string{"scale", "--replicas", "11", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp scale: invalid value "11" for --replicas: must be at most 10`)
+			})
+			Convey("Float", func() {
+				err := app.Run([]string{"scale", "--ratio", "1.5", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp scale: invalid value "1.5" for --ratio: must be at most 1`)
+			})
+			Convey("Pattern", func() {
+				err := app.Run([]string{"scale", "--name", "Web", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp scale: invalid value "Web" for --name: must match ^[a-z]+$`)
+			})
+			Convey("Slice elements", func() {
+				err := app.Run([]string{"scale", "--zone", "a", "--zone", "c", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp scale: invalid value "c" for --zone: must be one of a, b`)
+			})
+			Convey("Custom", func() {
+				err := app.Run([]string{"scale", "--force", "--replicas", "6", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "testapp scale: refusing to force more than 5 replicas")
+			})
+			Convey("Positionals", func() {
+				err := app.Run([]string{"scale", ""})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "testapp scale: <cluster> must not be empty")
+			})
+			Convey("Inherited options", func() {
+				app.Main.Options = []Option{
+					StringOption{Name: "env", ValueList: []string{"prod", "dev"}, Validation: ValueListValidation},
+				}
+				err := app.Run([]string{"--env", "test", "scale", "main"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp scale: invalid value "test" for --env: must be one of prod, dev`)
+			})
+		})
+		Convey("Command validation", func() {
+			var order []string
+			app.Main.Options = []Option{BoolOption{Name: "local"}}
+			app.Main.Validate = func(ctx *Context) error {
+				order = append(order, "validate main")
+				return nil
+			}
+			app.Main.Commands = []Command{{
+				Name: "deploy",
+				Options: []Option{
+					StringOption{Name: "cluster"},
+					IntOption{Name: "replicas"},
+				},
+				Validate: func(ctx *Context) error {
+					order = append(order, "validate deploy")
+					if ctx.Int("replicas") > 0 && ctx.String("cluster") == "" && !ctx.Bool("local") {
+						return errors.New("--replicas requires --cluster unless --local")
+					}
+					return nil
+				},
+				Before: func(ctx *Context) error {
+					order = append(order, "before")
+					return nil
+				},
+				Action: func(ctx *Context) error { return nil },
+			}}
+			Convey("Passing", func() {
+				So(app.Run([]string{"deploy", "--replicas", "2", "--local"}), ShouldBeNil)
+				So(order, ShouldResemble, []string{"validate main", "validate deploy", "before"})
+			})
+			Convey("Failing", func() {
+				err := app.Run([]string{"deploy", "--replicas", "2"})
+				So(err, ShouldNotBeNil)
+				So(order, ShouldResemble, []string{"validate main", "validate deploy"})
+				var usage UsageError
+				So(errors.As(err, &usage), ShouldBeTrue)
+				So(usage.Error(), ShouldEqual, "testapp deploy: --replicas requires --cluster unless --local")
+				So(usage.Hint, ShouldEqual, "run 'testapp help deploy' for usage")
+			})
+		})
+		Convey("After hooks", func() {
+			var order []string
+			var seen error
+			actionErr := errors.New("action failed")
+			hook := func(name string) func(*Context) error {
+				return func(*Context) error {
+					order = append(order, "before "+name)
+					return nil
+				}
+			}
+			after := func(name string) func(*Context, error) error {
+				return func(ctx *Context, err error) error {
+					order = append(order, "after "+name)
+					seen = err
+					return nil
+				}
+			}
+			app.Main.Before = hook("main")
+			app.Main.After = after("main")
+			app.Main.Commands = []Command{{
+				Name:   "db",
+				Before: hook("db"),
+				After:  after("db"),
+				Action: func(*Context) error { return actionErr },
+			}}
+			Convey("Run in reverse order with the action's error", func() {
+				err := app.Run([]string{"db"})
+				So(err, ShouldEqual, actionErr)
+				So(seen, ShouldEqual, actionErr)
+				So(order, ShouldResemble, []string{"before main", "before db", "after db", "after main"})
+			})
+			Convey("Run when Before fails", func() {
+				app.Main.Commands[0].Before = func(*Context) error {
+					order = append(order, "before db")
+					return errors.New("before failed")
+				}
+				app.Main.Commands[0].Action = func(*Context) error {
+					order = append(order, "action")
+					return nil
+				}
+				err := app.Run([]string{"db"})
+				So(err, ShouldNotBeNil)
+				So(order, ShouldResemble, []string{"before main", "before db", "after db", "after main"})
+			})
+			Convey("Errors are combined", func() {
+				closeErr := errors.New("close failed")
+				app.Main.After = func(ctx *Context, err error) error { return closeErr }
+				err := app.Run([]string{"db"})
+				So(errors.Is(err, actionErr), ShouldBeTrue)
+				So(errors.Is(err, closeErr), ShouldBeTrue)
+			})
+			Convey("Errors can be decorated", func() {
+				app.Main.After = func(ctx *Context, err error) error { return fmt.Errorf("db: %w", err) }
+				err := app.Run([]string{"db"})
+				So(err.Error(), ShouldEqual, "db: action failed")
+			})
+		})
+		Convey("Middleware", func() {
+			var order []string
+			trace := func(name string) Middleware {
+				return func(next func(*Context) error) func(*Context) error {
+					return func(ctx *Context) error {
+						order = append(order, name+" in")
+						err := next(ctx)
+						order = append(order, name+" out")
+						return err
+					}
+				}
+			}
+			app.Use(trace("app1"), trace("app2"))
+			app.Main.Use(trace("main"))
+			app.Main.Commands = []Command{{
+				Name: "cmd",
+				Action: func(*Context) error {
+					order = append(order, "action")
+					return nil
+				},
+			}}
+			app.Main.Commands[0].Use(trace("cmd"))
+			Convey("Wraps actions in order", func() {
+				So(app.Run([]string{"cmd"}), ShouldBeNil)
+				So(order, ShouldResemble, []string{"app1 in", "app2 in", "main in", "cmd in", "action", "cmd out", "main out", "app2 out", "app1 out"})
+			})
+			Convey("Wraps help", func() {
+				app.Out = &bytes.Buffer{}
+				So(app.Run([]string{"help"}), ShouldBeNil)
+				So(order, ShouldResemble, []string{"app1 in", "app2 in", "main in", "main out", "app2 out", "app1 out"})
+				order = nil
+				So(app.Run([]string{"cmd", "--help"}), ShouldBeNil)
+				So(order, ShouldResemble, []string{"app1 in", "app2 in", "main in", "cmd in", "cmd out", "main out", "app2 out", "app1 out"})
+			})
+			Convey("Can decorate errors", func() {
+				app.Main.Commands[0].Action = func(*Context) error { return errors.New("failed") }
+				app.Use(func(next func(*Context) error) func(*Context) error {
+					return func(ctx *Context) error {
+						if err := next(ctx); err != nil {
+							return fmt.Errorf("cmd: %w", err)
+						}
+						return nil
+					}
+				})
+				So(app.Run([]string{"cmd"}).Error(), ShouldEqual, "cmd: failed")
+			})
+		})
+		Convey("Panic recovery", func() {
+			var afterErr error
+			app.RecoverPanics = true
+			app.Main.After = func(ctx *Context, err error) error {
+				afterErr = err
+				return nil
+			}
+			app.Main.Action = func(*Context) error { panic("boom") }
+			err := app.Run([]string{})
+			var p PanicError
+			So(errors.As(err, &p), ShouldBeTrue)
+			So(p.Value, ShouldEqual, "boom")
+			So(string(p.Stack), ShouldContainSubstring, "goroutine")
+			So(err.Error(), ShouldEqual, "panic: boom")
+			So(afterErr, ShouldHaveSameTypeAs, PanicError{})
+			Convey("In After hooks", func() {
+				app.Main.Action = func(*Context) error { return nil }
+				app.Main.After = func(*Context, error) error { panic(errors.New("after")) }
+				err := app.Run([]string{})
+				So(errors.As(err, &p), ShouldBeTrue)
+				So(err.Error(), ShouldEqual, "panic: after")
+			})
+		})
+		Convey("Exit codes", func() {
+			Convey("Wrapped exits", func() {
+				err := fmt.Errorf("deploy: %w", Exit{Err: errors.New("failed"), StatusCode: 3})
+				So(DefaultExitCode(err), ShouldEqual, 3)
+				var exit Exit
+				So(errors.As(err, &exit), ShouldBeTrue)
+				So(errors.Unwrap(exit).Error(), ShouldEqual, "failed")
+			})
+			Convey("Conventional defaults", func() {
+				So(DefaultExitCode(nil), ShouldEqual, 0)
+				So(DefaultExitCode(errors.New("failed")), ShouldEqual, 1)
+				So(DefaultExitCode(app.Run([]string{"--unknown"})), ShouldEqual, ExitUsage)
+				So(DefaultExitCode(fmt.Errorf("stopped: %w", ErrInterrupted)), ShouldEqual, ExitInterrupted)
+				So(DefaultExitCode(ConfigError{Err: errors.New("no config")}), ShouldEqual, ExitConfig)
+				So(DefaultExitCode(PanicError{Value: "boom"}), ShouldEqual, ExitPanic)
+			})
+		})
+		Convey("Cancellation", func() {
+			var afterErr error
+			var deadline bool
+			app.GracePeriod = time.Minute
+			app.Main.Commands = []Command{{
+				Name: "wait",
+				Action: func(ctx *Context) error {
+					<-ctx.Context().Done()
+					return ctx.Context().Err()
+				},
+				After: func(ctx *Context, err error) error {
+					afterErr = ctx.Context().Err()
+					_, deadline = ctx.Context().Deadline()
+					return err
+				},
+			}}
+			parent, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := app.RunContext(parent, []string{"wait"})
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+			So(afterErr, ShouldBeNil)
+			So(deadline, ShouldBeTrue)
+		})
+		Convey("Passing values along the path", func() {
+			type clientKey struct{}
+			var client interface{}
+			app.Main.Before = func(ctx *Context) error {
+				ctx.Set(clientKey{}, "client")
+				return nil
+			}
+			app.Main.Commands = []Command{{
+				Name: "list",
+				Action: func(ctx *Context) error {
+					client = ctx.Value(clientKey{})
+					return nil
+				},
+			}}
+			err := app.Run([]string{"list"})
+			So(err, ShouldBeNil)
+			So(client, ShouldEqual, "client")
+			app.Main.Before = nil
+			client = "stale"
+			app.Run([]string{"list"})
+			So(client, ShouldBeNil)
+		})
+		Convey("Typed values", func() {
+			type clientKey struct{}
+			var name string
+			var found, mistyped bool
+			app.Main.Before = func(ctx *Context) error {
+				ctx.Set(clientKey{}, "client")
+				return nil
+			}
+			app.Main.Action = func(ctx *Context) error {
+				name, found = ValueOf[string](ctx, clientKey{})
+				_, mistyped = ValueOf[int](ctx, clientKey{})
+				return nil
+			}
+			So(app.Run([]string{}), ShouldBeNil)
+			So(name, ShouldEqual, "client")
+			So(found, ShouldBeTrue)
+			So(mistyped, ShouldBeFalse)
+		})
+		Convey("Injected environment and streams", func() {
+			var b, e bytes.Buffer
+			var region string
+			app.Out, app.Err = &b, &e
+			app.Getenv = func(key string) string {
+				return map[string]string{"REGION": "eu"}[key]
+			}
+			app.Main.Commands = []Command{{
+				Name:    "deploy",
+				Usage:   "deploy it",
+				Options: []Option{StringOption{Name: "region", EnvVar: "REGION"}},
+				Action: func(ctx *Context) error {
+					region = ctx.String("region")
+					return errors.New("failed")
+				},
+			}}
+			var code int
+			app.Args = []string{"testapp", "deploy"}
+			app.Exit = func(c int) { code = c }
+			app.RunMain()
+			So(region, ShouldEqual, "eu")
+			So(code, ShouldEqual, 1)
+			So(e.String(), ShouldEqual, "failed\n")
+			app.Run([]string{"help-commands"})
+			So(b.String(), ShouldEqual, "testapp deploy  # deploy it\n")
+		})
+		Convey("Unset streams and arguments", func() {
+			code := -1
+			bare := &App{Name: "testapp", Args: []string{}, Exit: func(c int) { code = c }}
+			bare.Main.Commands = []Command{{Name: "deploy", Usage: "deploy it", Action: func(*Context) error { return nil }}}
+			r, w, _ := os.Pipe()
+			stdout := os.Stdout
+			os.Stdout = w
+			bare.RunMain()
+			err := bare.Run([]string{"help-commands"})
+			os.Stdout = stdout
+			w.Close()
+			out, _ := io.ReadAll(r)
+			So(code, ShouldEqual, 0)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEndWith, "testapp deploy  # deploy it\n")
+		})
+		Convey("Redeclaration messages go to Err", func() {
+			var e bytes.Buffer
+			app.Err = &e
+			app.Main.Options = []Option{StringOption{Name: "region"}, StringOption{Name: "region"}}
+			So(func() { app.Run([]string{}) }, ShouldPanic)
+			So(e.String(), ShouldEqual, "flag redeclared: region\n")
+		})
+		Convey("Second interrupt", func() {
+			exits := make(chan int, 2)
+			var forced, final int
+			app.Err = &bytes.Buffer{}
+			app.Args = []string{"testapp"}
+			app.Exit = func(code int) { exits <- code }
+			app.Main.Action = func(ctx *Context) error {
+				self, _ := os.FindProcess(os.Getpid())
+				self.Signal(os.Interrupt)
+				<-ctx.Context().Done()
+				self.Signal(os.Interrupt)
+				forced = <-exits
+				return ctx.Context().Err()
+			}
+			app.RunMain()
+			final = <-exits
+			So(forced, ShouldEqual, ExitInterrupted)
+			So(final, ShouldEqual, ExitInterrupted)
+		})
+		Convey("Tree validation", func() {
+			app.Main.Options = []Option{StringOption{Name: "region"}, BoolOption{Name: "dry", Local: true}}
+			app.Main.Commands = []Command{
+				{Name: "deploy", ShortName: "d", Options: []Option{BoolOption{Name: "dry"}}},
+				{Name: "destroy", ShortName: "d"},
+				{
+					Name:          "scale",
+					TimeoutOption: true,
+					Args:          []Option{IntOption{Name: "from", Optional: true}, IntOption{Name: "to"}},
+					Options:       []Option{StringOption{Name: "region, h"}},
+					Commands:      []Command{{Name: "up", Options: []Option{StringOption{Name: "timeout"}}}},
+				},
+			}
+			err := app.Validate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "5 errors:\n"+
+				"  - testapp: duplicate subcommand name \"d\"\n"+
+				"  - testapp scale: required argument <to> follows optional argument <from>\n"+
+				"  - testapp scale: option --region is already declared by testapp\n"+
+				"  - testapp scale: option -h is already declared by the built-in options\n"+
+				"  - testapp scale up: option --timeout is already declared by the built-in options")
+		})
+		Convey("Valid tree", func() {
+			app.Main.Commands = []Command{{Name: "deploy", Options: []Option{StringOption{Name: "region"}}}}
+			AssertValid(t, app)
+		})
+		Convey("Concurrent runs", func() {
+			app.Out = &bytes.Buffer{}
+			app.Main.Commands = []Command{{
+				Name:    "echo",
+				Options: []Option{StringSliceOption{Name: "word"}, IntOption{Name: "n"}},
+				Action: func(ctx *Context) error {
+					if want := fmt.Sprint(ctx.Int("n")); ctx.StringSlice("word")[0] != want {
+						return fmt.Errorf("got %v, want %s", ctx.StringSlice("word"), want)
+					}
+					return nil
+				},
+			}}
+			errs := make([]error, 20)
+			var wg sync.WaitGroup
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					n := fmt.Sprint(i)
+					errs[i] = app.Run([]string{"echo", "--n", n, "--word", n})
+				}(i)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(len(app.Main.Commands), ShouldEqual, 1)
+		})
+		Convey("Command path", func() {
+			var path string
+			var parent *Command
+			var ctxApp *App
+			action := func(ctx *Context) error {
+				path, parent, ctxApp = ctx.CommandPath(), ctx.Parent(), ctx.App()
+				return nil
+			}
+			app.Main.Commands = []Command{{
+				Name:     "db",
+				Commands: []Command{{Name: "migrate", Action: action}},
+			}}
+			err := app.Run([]string{"db", "migrate"})
+			So(err, ShouldBeNil)
+			So(path, ShouldEqual, "testapp db migrate")
+			So(parent.Name, ShouldEqual, "db")
+			So(ctxApp, ShouldEqual, app)
+			app.Main.Action = action
+			app.Run([]string{})
+			So(path, ShouldEqual, "testapp")
+			So(parent, ShouldBeNil)
+		})
+		Convey("Timeouts", func() {
+			app.Main.Commands = []Command{{
+				Name: "wait",
+				Action: func(ctx *Context) error {
+					<-ctx.Context().Done()
+					return ctx.Context().Err()
+				},
+			}}
+			Convey("Declared on the command", func() {
+				app.Main.Commands[0].Timeout = time.Millisecond
+				err := app.Run([]string{"wait"})
+				So(err, ShouldResemble, TimeoutError{time.Millisecond})
+				So(DefaultExitCode(err), ShouldEqual, ExitTimeout)
+			})
+			Convey("Given as an option", func() {
+				app.Main.Timeout = time.Hour
+				app.Main.TimeoutOption = true
+				err := app.Run([]string{"wait", "--timeout", "1ms"})
+				So(err, ShouldResemble, TimeoutError{time.Millisecond})
+				err = app.Run([]string{"wait", "--timeout", "soon"})
+				So(DefaultExitCode(err), ShouldEqual, ExitUsage)
+				err = app.Run([]string{"wait", "--timeout", "-5s"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp wait: invalid value "-5s" for --timeout: must not be negative`)
+			})
+			Convey("Shown in help", func() {
+				var b bytes.Buffer
+				app.Out = &b
+				app.Main.Timeout = time.Hour
+				app.Main.TimeoutOption = true
+				app.Run([]string{"help", "wait"})
+				So(b.String(), ShouldContainSubstring, "--timeout    abort the command after this duration, 0 for no limit; default = \"1h0m0s\"")
+			})
+		})
+		Convey("Error presentation", func() {
+			app.Err = &bytes.Buffer{}
+			app.Main.Commands = []Command{{
+				Name:     "deploy",
+				ArgCount: ExactArgs(1),
+				Action:   func(*Context) error { return errors.New("failed") },
+			}}
+			Convey("Runtime errors", func() {
+				err := app.Run([]string{"deploy", "prod"})
+				So(ErrorFormat{}.Format(app, err), ShouldEqual, "failed")
+				So(ErrorFormat{AppName: true}.Format(app, err), ShouldEqual, "testapp: failed")
+				So(ErrorFormat{Color: true}.Format(app, err), ShouldEqual, "failed")
+			})
+			Convey("Usage errors", func() {
+				err := app.Run([]string{"deploy"})
+				So(ErrorFormat{AppName: true}.Format(app, err), ShouldEqual, "testapp deploy: expected exactly 1 argument, got 0")
+				So(ErrorFormat{Hint: true}.Format(app, err), ShouldEqual, "testapp deploy: expected exactly 1 argument, got 0\nrun 'testapp help deploy' for usage")
+				So(ErrorFormat{Usage: true}.Format(app, err), ShouldEqual, "Usage: testapp deploy <arg>\n\ntestapp deploy: expected exactly 1 argument, got 0")
+			})
+			Convey("Silent exits", func() {
+				So(ErrorFormat{AppName: true}.Format(app, Exit{StatusCode: 3}), ShouldEqual, "")
+			})
+			Convey("Command line", func() {
+				app.Main.Commands[0].Options = []Option{
+					StringOption{Name: "region", Validation: OneOfValidation("eu", "us")},
+				}
+				err := app.Run([]string{"deploy", "--region", "mars", "prod"})
+				So(ErrorFormat{CommandLine: true}.Format(app, err), ShouldEqual, "testapp deploy: invalid value \"mars\" for --region: must be one of eu, us\n"+
+					"  testapp deploy --region mars prod\n"+
+					"                          ^^^^")
+				err = app.Run([]string{"deploy", "prod", "staging"})
+				So(ErrorFormat{CommandLine: true}.Format(app, err), ShouldEndWith, "\n"+
+					"  testapp deploy prod staging\n"+
+					"                      ^^^^^^^")
+				err = app.Run([]string{"deploy"})
+				So(ErrorFormat{CommandLine: true}.Format(app, err), ShouldEndWith, "\n"+
+					"  testapp deploy\n"+
+					"                 ^")
+				err = app.Run([]string{"deploy", "--unknown", "prod"})
+				So(ErrorFormat{}.Format(app, err), ShouldEqual, "testapp deploy: unknown argument --unknown")
+			})
+			Convey("Repeated slice options", func() {
+				app.Main.Commands[0].Options = []Option{
+					StringSliceOption{Name: "zone", Validation: OneOfValidation("a", "b")},
+				}
+				err := app.Run([]string{"deploy", "--zone", "c", "--zone", "a", "prod"})
+				So(ErrorFormat{CommandLine: true}.Format(app, err), ShouldEqual, "testapp deploy: invalid value \"c\" for --zone: must be one of a, b\n"+
+					"  testapp deploy --zone c --zone a prod\n"+
+					"                        ^")
+				err = app.Run([]string{"deploy", "--zone=a", "--zone=c", "prod"})
+				So(ErrorFormat{CommandLine: true}.Format(app, err), ShouldEndWith, "\n"+
+					"  testapp deploy --zone=a --zone=c prod\n"+
+					"                          ^^^^^^^^")
+			})
+			Convey("Default format on non-terminals", func() {
+				var e bytes.Buffer
+				app.Err = &e
+				app.Args = []string{"testapp", "deploy", "prod", "staging"}
+				app.Exit = func(int) {}
+				app.RunMain()
+				So(e.String(), ShouldEqual, "testapp deploy: expected exactly 1 argument, got 2\n"+
+					"  testapp deploy prod staging\n"+
+					"                      ^^^^^^^\n"+
+					"run 'testapp help deploy' for usage\n")
+			})
+		})
 		Convey("Option types", func() {
 			Convey("String slice", func() {
 				var o []string
@@ -54,8 +853,98 @@ func TestApp(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(o, ShouldResemble, []string{"1", "2", "3"})
 			})
+			Convey("Negated string slice", func() {
+				var o []string
+				app.Main.Name = "_main"
+				app.Main.Options = []Option{
+					StringSliceOption{Name: "o", Negatable: true},
+				}
+				app.Main.Action = func(ctx *Context) error {
+					o = ctx.StringSlice("o")
+					return nil
+				}
+				err := app.Run([]string{"--o", "1", "--no-o", "--o", "2"})
+				So(err, ShouldBeNil)
+				So(o, ShouldResemble, []string{"2"})
+			})
 
 		})
+		Convey("Repeated options", func() {
+			var region string
+			app.Main.Options = []Option{
+				StringOption{Name: "region, r"},
+			}
+			app.Main.Action = func(ctx *Context) error {
+				region = ctx.String("region")
+				return nil
+			}
+			Convey("Last wins", func() {
+				err := app.Run([]string{"--region", "a", "-r", "b"})
+				So(err, ShouldBeNil)
+				So(region, ShouldEqual, "b")
+			})
+			Convey("Error across aliases", func() {
+				app.RepeatPolicy = flags.RepeatError
+				err := app.Run([]string{"--region", "a", "-r", "b"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, `"-r b"`)
+			})
+			Convey("Error positions after a subcommand", func() {
+				app.RepeatPolicy = flags.RepeatError
+				app.Main.Commands = []Command{{Name: "deploy", Action: func(*Context) error { return nil }}}
+				err := app.Run([]string{"deploy", "--region", "a", "--region", "b"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, `testapp deploy: option given more than once: "--region a" at argument 2 and "--region b" at argument 4`)
+			})
+		})
+		Convey("Option occurrences", func() {
+			var occ []Occurrence
+			app.Main.Commands = []Command{{
+				Name: "filter",
+				Options: []Option{
+					StringSliceOption{Name: "include, i"},
+					StringSliceOption{Name: "exclude"},
+				},
+				Action: func(ctx *Context) error {
+					occ = ctx.Occurrences()
+					return nil
+				},
+			}}
+			err := app.Run([]string{"filter", "--include", "a", "--exclude", "b", "-i", "c"})
+			So(err, ShouldBeNil)
+			So(len(occ), ShouldEqual, 3)
+			So([]string{occ[0].Name, occ[1].Name, occ[2].Name}, ShouldResemble, []string{"include", "exclude", "include"})
+			So([]string{occ[0].Value, occ[1].Value, occ[2].Value}, ShouldResemble, []string{"a", "b", "c"})
+			So(occ[2].Index, ShouldEqual, 5)
+		})
+		Convey("Negative numbers", func() {
+			var n int
+			app.Main.Commands = []Command{{
+				Name: "scale",
+				Args: []Option{IntOption{Name: "n"}},
+				Action: func(ctx *Context) error {
+					n = ctx.Int("n")
+					return nil
+				},
+			}}
+			err := app.Run([]string{"scale", "-5"})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, -5)
+		})
+		Convey("Dash arguments", func() {
+			var args []string
+			app.Main.Commands = []Command{{
+				Name:          "exec",
+				AllowDashArgs: true,
+				Action: func(ctx *Context) error {
+					args = ctx.Args()
+					return nil
+				},
+			}}
+			err := app.Run([]string{"exec", "-la", "ls"})
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []string{"-la", "ls"})
+		})
 		Convey("Given flags", func() {
 			app.Main = Command{
 				Commands: []Command{{
@@ -126,6 +1015,61 @@ func TestApp(t *testing.T) {
 						So(b.String(), ShouldEqual, "a\nb\n")
 					})
 				})
+				Convey("Values of aliased and built-in options", func() {
+					app.Main = Command{
+						TimeoutOption: true,
+						Options: []Option{
+							StringOption{
+								Name:       "region, r",
+								Completion: func(*Context, Option) []string { return []string{"eu", "us"} },
+							},
+						},
+					}
+					err := app.Run([]string{"--timeout"})
+					So(err, ShouldBeNil)
+					So(b.String(), ShouldEqual, "")
+					err = app.Run([]string{"-r"})
+					So(err, ShouldBeNil)
+					So(b.String(), ShouldEqual, "eu\nus\n")
+				})
+				Convey("Negated flags", func() {
+					app.Main = Command{
+						Options: []Option{
+							BoolOption{Name: "verbose, v"},
+							BoolOption{Name: "force", DisableNegation: true},
+							StringSliceOption{Name: "tag", Negatable: true},
+						},
+					}
+					app.Run([]string{})
+					So(b.String(), ShouldEqual, "--verbose\n-v\n--no-verbose\n--force\n--tag\n--no-tag\n")
+				})
+				Convey("After an intermediate positional", func() {
+					app.Main = Command{
+						Commands: []Command{{
+							Name:     "project",
+							Args:     []Option{StringOption{Name: "name"}},
+							Commands: []Command{{Name: "build"}},
+						}},
+					}
+					app.Run([]string{"project", "web"})
+					So(b.String(), ShouldEqual, "build\n")
+				})
+				Convey("Attached value completion", func() {
+					app.Main = Command{
+						Options: []Option{
+							StringOption{
+								Name:          "color",
+								OptionalValue: true,
+								BareValue:     "always",
+								ValueList:     []string{"always", "never", "auto"},
+								Completion:    ValueListCompletion,
+							},
+						},
+					}
+					err := app.Run([]string{"--color="})
+					So(err, ShouldBeNil)
+					So(b.String(), ShouldEqual, "always\nnever\nauto\n")
+				})
 				Convey("Help completion", func() {
 					app.Main = Command{
 						Commands: []Command{{
@@ -179,6 +1123,13 @@ func TestApp(t *testing.T) {
 					So(b.String(), ShouldEqual, "\nUsage: testapp cmd1\n\ncmd1 usage\n\nSubcommands:\n  sub1\n\nOptions:\n  --int       default = 0\n  --string    default = \"\"\n")
 				})
 			})
+			Convey("Optional values", func() {
+				app.Main.Options = []Option{
+					StringOption{Name: "color", OptionalValue: true, ValueName: "WHEN"},
+				}
+				app.Run([]string{"--help"})
+				So(b.String(), ShouldContainSubstring, "\n  --color[=WHEN]    default = \"\"\n")
+			})
 			Convey("Using an option", func() {
 				Convey("Root", func() {
 					app.Run([]string{"--help"})
@@ -3,7 +3,11 @@ package cli
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
+	"time"
+
+	"bitbucket.org/ulfurinn/cli/flags"
 )
 
 type Command struct {
@@ -16,6 +20,97 @@ type Command struct {
 	Before     func(*Context) error
 	Action     func(*Context) error
 	Completion func(*Context)
+	// Validate checks the options and arguments as a whole; it runs for every command
+	// in the path after option validation and before Before, failing with a UsageError.
+	Validate func(*Context) error
+	// After runs in reverse order along the command path once the action has finished,
+	// for every command whose Before was reached, even if Before or the action failed.
+	// It receives the error so far; an error it returns is joined to that one unless it wraps it.
+	After func(*Context, error) error
+	// AllowDashArgs makes unrecognised dash-prefixed arguments positional instead of failing the parse.
+	AllowDashArgs bool
+	// ArgCount constrains the number of arguments left over after parsing; unconstrained by default.
+	ArgCount ArgCount
+	// Middleware wraps the action of this command and of all its subcommands.
+	Middleware []Middleware
+	// Timeout is the deadline applied to the context of Before and the action of
+	// this command and its subcommands, unless they declare their own.
+	Timeout time.Duration
+	// TimeoutOption exposes the built-in --timeout option on this command and its
+	// subcommands, overriding Timeout.
+	TimeoutOption bool
+}
+
+// Middleware wraps an action with behaviour of its own, calling next to proceed.
+// Middleware declared on the App comes first, followed by that of each command
+// down the path; within a list, earlier entries wrap the later ones.
+type Middleware func(next func(*Context) error) func(*Context) error
+
+// Use adds middleware to the command.
+func (c *Command) Use(middleware ...Middleware) {
+	c.Middleware = append(c.Middleware, middleware...)
+}
+
+// ArgCount is a constraint on the number of free arguments a command accepts.
+type ArgCount struct {
+	min, max int // max < 0 is unbounded
+	declared bool
+}
+
+func NoArgs() ArgCount                { return ArgCount{0, 0, true} }
+func ExactArgs(n int) ArgCount        { return ArgCount{n, n, true} }
+func MinArgs(n int) ArgCount          { return ArgCount{n, -1, true} }
+func MaxArgs(n int) ArgCount          { return ArgCount{0, n, true} }
+func RangeArgs(min, max int) ArgCount { return ArgCount{min, max, true} }
+
+func (a ArgCount) check(n int) error {
+	if !a.declared || (n >= a.min && (a.max < 0 || n <= a.max)) {
+		return nil
+	}
+	var expected string
+	bound := a.max
+	switch {
+	case a.max == 0:
+		return fmt.Errorf("accepts no arguments, got %d", n)
+	case a.min == a.max:
+		expected = fmt.Sprintf("exactly %d", a.min)
+	case a.max < 0:
+		expected, bound = fmt.Sprintf("at least %d", a.min), a.min
+	case a.min == 0:
+		expected = fmt.Sprintf("at most %d", a.max)
+	default:
+		expected = fmt.Sprintf("between %d and %d", a.min, a.max)
+	}
+	noun := "arguments"
+	if bound == 1 {
+		noun = "argument"
+	}
+	return fmt.Errorf("expected %s %s, got %d", expected, noun, n)
+}
+
+// usage renders the constraint for the help usage line.
+func (a ArgCount) usage() string {
+	if !a.declared {
+		return ""
+	}
+	var parts []string
+	for i := 0; i < a.min; i++ {
+		parts = append(parts, "<arg>")
+	}
+	switch {
+	case a.max < 0 && a.min > 0:
+		parts[len(parts)-1] += "..."
+	case a.max < 0:
+		parts = append(parts, "[<arg>...]")
+	default:
+		for i := a.min; i < a.max; i++ {
+			parts = append(parts, "[<arg>]")
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " " + strings.Join(parts, " ")
 }
 
 func (c *Command) HasName(name string) bool {
@@ -32,17 +127,111 @@ func (c *Command) FindCommandByName(name string) (cmd *Command) {
 	return
 }
 
+// FindCommand resolves the command path from the context's arguments.
+// Options visible at each level may precede the subcommand name; they stay in
+// the arguments to be parsed once the path is known, while the names are removed.
+// An intermediate command takes its positionals before the subcommand name if
+// that leaves a subcommand to descend into; otherwise its required positionals
+// are reported missing, unless the subcommand is one of the built-in help commands.
 func (c *Command) FindCommand(ctx *Context) {
 	ctx.commands = append(ctx.commands, *c)
-	if len(ctx.args) == 0 {
+	if len(ctx.args) == 0 || len(c.Commands) == 0 {
 		return
 	}
-	a := ctx.args[0]
+	for _, withArgs := range []bool{true, false} {
+		if withArgs && len(c.Args) == 0 {
+			continue
+		}
+		if i, sub := c.findSubcommand(ctx, withArgs); sub != nil {
+			if !withArgs && !sub.HasName(HelpCommand.Name) && !sub.HasName(HelpTreeCommand.Name) {
+				for _, arg := range c.Args {
+					if !arg.optional() {
+						ctx.pathErrors = append(ctx.pathErrors, fmt.Errorf("no value provided for argument %s", firstName(arg.name())))
+					}
+				}
+			}
+			ctx.argLevels = append(ctx.argLevels, withArgs)
+			ctx.dropArg(i)
+			sub.FindCommand(ctx)
+			return
+		}
+	}
+}
+
+// findSubcommand locates the subcommand name among the context's arguments.
+func (c *Command) findSubcommand(ctx *Context, withArgs bool) (int, *Command) {
+	set, _ := ctx.optionSet(withArgs)
+	set.Out = ioutil.Discard
+	if err := set.Parse(ctx.args); err != nil || set.Terminated() {
+		return 0, nil // the final parse will report errors
+	}
+	rest := set.Args()
+	if len(rest) == 0 {
+		return 0, nil
+	}
+	return len(ctx.args) - len(rest), c.FindCommandByName(rest[0])
+}
+
+// builtinOwner stands for the built-in options in validation messages.
+const builtinOwner = "the built-in options"
+
+// validateTree reports structural problems in the command and its subcommands.
+// declared maps the option names visible to the command to where they were declared.
+func (c *Command) validateTree(path string, declared map[string]string, errs *flags.Errors) {
+	visible, inherited := map[string]string{}, map[string]string{}
+	for name, owner := range declared {
+		visible[name], inherited[name] = owner, owner
+	}
+	declare := func(kind string, opt Option, inherit bool) {
+		eachName(opt.name(), func(name string) {
+			display := kind + " " + prefixFor(name) + name
+			if kind == "argument" {
+				display = kind + " <" + name + ">"
+			}
+			if owner, ok := visible[name]; ok {
+				*errs = append(*errs, fmt.Errorf("%s: %s is already declared by %s", path, display, owner))
+				return
+			}
+			visible[name] = path
+			if inherit {
+				inherited[name] = path
+			}
+		})
+	}
+	var optional Option
+	for _, arg := range c.Args {
+		if arg.optional() {
+			optional = arg
+		} else if optional != nil {
+			*errs = append(*errs, fmt.Errorf("%s: required argument <%s> follows optional argument <%s>", path, firstName(arg.name()), firstName(optional.name())))
+		}
+		declare("argument", arg, true)
+	}
+	for _, opt := range c.Options {
+		declare("option", opt, !opt.local())
+	}
+	if c.TimeoutOption && visible[TimeoutOption.Name] != builtinOwner {
+		if owner, ok := visible[TimeoutOption.Name]; ok {
+			*errs = append(*errs, fmt.Errorf("%s: option --%s is already declared by %s", path, TimeoutOption.Name, owner))
+		}
+		inherited[TimeoutOption.Name] = builtinOwner
+	}
+	names := map[string]bool{}
 	for i := range c.Commands {
-		if c.Commands[i].HasName(a) {
-			ctx.args = ctx.args[1:]
-			c.Commands[i].FindCommand(ctx)
+		sub := &c.Commands[i]
+		if sub.Name == "" {
+			*errs = append(*errs, fmt.Errorf("%s: subcommand without a name", path))
 		}
+		for _, name := range []string{sub.Name, sub.ShortName} {
+			if name == "" {
+				continue
+			}
+			if names[name] {
+				*errs = append(*errs, fmt.Errorf("%s: duplicate subcommand name %q", path, name))
+			}
+			names[name] = true
+		}
+		sub.validateTree(path+" "+sub.Name, inherited, errs)
 	}
 }
 
@@ -57,7 +246,10 @@ func (c *Command) expanded() map[string]Command {
 	return result
 }
 
+// appendHelp adds the built-in help commands unless already declared,
+// without writing to the backing array of the original list.
 func (c *Command) appendHelp() {
+	c.Commands = c.Commands[:len(c.Commands):len(c.Commands)]
 	hasHelp := false
 	hasHelpCommands := false
 	for _, com := range c.Commands {
@@ -81,11 +273,18 @@ func (c *Command) showCompletion(ctx *Context) {
 		c.Completion(ctx)
 		return
 	}
-	if missing := ctx.options.MissingValue; missing != nil {
-		opt := ctx.findOption(missing.Name)
+	if opt := ctx.attachedOption(); opt != nil {
 		if f := opt.completion(); f != nil {
-			showCompletion(ctx.app.Out, f(ctx, opt))
-			return
+			showCompletion(ctx.app.outWriter(), f(ctx, opt))
+		}
+		return
+	}
+	if missing := ctx.options.MissingValue; missing != nil {
+		if opt := ctx.findOption(missing.Name); opt != nil {
+			if f := opt.completion(); f != nil {
+				showCompletion(ctx.app.outWriter(), f(ctx, opt))
+				return
+			}
 		}
 	}
 	if ctx.parseError != nil {
@@ -100,7 +299,7 @@ func (c *Command) showCompletion(ctx *Context) {
 	for _, opt := range c.Options {
 		list = append(list, opt.CompletionStrings()...)
 	}
-	showCompletion(ctx.app.Out, list)
+	showCompletion(ctx.app.outWriter(), list)
 }
 
 func showCompletion(out io.Writer, strings []string) {
@@ -129,19 +328,9 @@ func ValueListCompletion(ctx *Context, opt Option) []string {
 }
 
 func ValueListValidation(ctx *Context, opt Option) error {
-	// default values always pass
-	if lowOpt := ctx.options.Lookup(opt.name()); lowOpt != nil && !lowOpt.Value.Explicit() {
-		return nil
-	}
 	switch o := opt.(type) {
 	case StringOption:
-		givenValue := ctx.String(o.Name)
-		for _, allowedValue := range o.ValueList {
-			if givenValue == allowedValue {
-				return nil
-			}
-		}
-		return fmt.Errorf("%s accepts one of the following values: %s", o.Name, strings.Join(o.ValueList, ","))
+		return OneOfValidation(o.ValueList...)(ctx, opt)
 	default:
 		return nil
 	}
@@ -1,13 +1,71 @@
 package cli
 
-import "bitbucket.org/ulfurinn/cli/flags"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"bitbucket.org/ulfurinn/cli/flags"
+)
 
 type Context struct {
+	ctx        context.Context
 	app        *App
+	argv       []string // arguments passed to App.Run
 	args       []string
+	positions  []int    // index in the arguments passed to App.Run of each element of args
+	parsed     []string // arguments as given to the option parser
 	commands   []Command
+	argLevels  []bool  // whether each intermediate command in the path took its positionals
+	pathErrors []error // required positionals of intermediate commands missing before the subcommand name
 	options    *flags.Set
+	named      map[string]Option
 	parseError error
+	values     map[interface{}]interface{}
+}
+
+// Occurrence describes a single appearance of a named option on the command line.
+type Occurrence struct {
+	Name    string // the first declared name of the option, whichever alias was used
+	Option  Option
+	Value   string // the value the occurrence stands for, such as "true" for a bare bool or the default for a negated option; empty for negated accumulating options
+	Raw     string // the value as written; empty if none was given
+	Negated bool
+	Ignored bool // skipped under RepeatFirstWins
+	Index   int  // position of the option in the arguments passed to App.Run
+}
+
+// Context returns the context the application was run with; it is cancelled on
+// interrupt under RunMain. After hooks of a cancelled command get a fresh one,
+// limited by the application's grace period.
+func (c *Context) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Set stores a value under key for the rest of the invocation, making it available
+// to the hooks, middleware and action of every command in the path.
+func (c *Context) Set(key, value interface{}) {
+	if c.values == nil {
+		c.values = map[interface{}]interface{}{}
+	}
+	c.values[key] = value
+}
+
+// Value returns the value stored under key, or nil.
+func (c *Context) Value(key interface{}) interface{} {
+	return c.values[key]
+}
+
+// ValueOf returns the value stored under key as a T, and whether one of that type was stored.
+func ValueOf[T any](c *Context, key interface{}) (T, bool) {
+	v, ok := c.values[key].(T)
+	return v, ok
 }
 
 func (c *Context) Arg(i int) string {
@@ -82,8 +140,83 @@ func (c *Context) StringSlice(name string) (v []string) {
 	return
 }
 
+// Occurrences returns the named options in the order they were given, including repetitions.
+func (c *Context) Occurrences() (occurrences []Occurrence) {
+	for _, occ := range c.options.Occurrences() {
+		opt, ok := c.named[occ.Name]
+		if !ok {
+			continue
+		}
+		occurrences = append(occurrences, Occurrence{
+			Name:    firstName(opt.name()),
+			Option:  opt,
+			Value:   occ.Value,
+			Raw:     occ.Raw,
+			Negated: occ.Negated,
+			Ignored: occ.Ignored,
+			Index:   c.position(occ.Index),
+		})
+	}
+	return
+}
+
+// position maps an index into the parsed arguments back to the arguments passed to App.Run.
+func (c *Context) position(i int) int {
+	if i < len(c.positions) {
+		return c.positions[i]
+	}
+	return i
+}
+
+// dropArg removes an argument consumed during command resolution.
+func (c *Context) dropArg(i int) {
+	if len(c.positions) != len(c.args) {
+		c.positions = make([]int, len(c.args))
+		for k := range c.positions {
+			c.positions[k] = k
+		}
+	}
+	c.args = append(c.args[:i:i], c.args[i+1:]...)
+	c.positions = append(c.positions[:i:i], c.positions[i+1:]...)
+}
+
+// fullName is the application name followed by the names of the commands in the path.
+func (c *Context) fullName() string {
+	name := c.app.Name
+	for _, cmd := range c.commands[1:] {
+		name += " " + cmd.Name
+	}
+	return name
+}
+
+func (c *Context) usageError(err error) UsageError {
+	help := c.app.Name + " help"
+	for _, cmd := range c.commands[1:] {
+		help += " " + cmd.Name
+	}
+	return UsageError{
+		Command: c.fullName(),
+		Hint:    fmt.Sprintf("run '%s' for usage", help),
+		Err:     err,
+		ctx:     c,
+	}
+}
+
 func (c *Context) Command() *Command { return &c.commands[len(c.commands)-1] }
 
+// Parent returns the command the current one is a subcommand of, or nil for the root command.
+func (c *Context) Parent() *Command {
+	if len(c.commands) < 2 {
+		return nil
+	}
+	return &c.commands[len(c.commands)-2]
+}
+
+// CommandPath is the application name followed by the names of the commands in the path, such as "app db migrate".
+func (c *Context) CommandPath() string { return c.fullName() }
+
+func (c *Context) App() *App { return c.app }
+
 func (c *Context) run() (err error) {
 	c.setupOptions()
 	err = c.parseOptions()
@@ -101,94 +234,377 @@ func (c *Context) run() (err error) {
 	}
 
 	if help {
-		err = helpOptionAction(c)
+		err = c.call(func() error { return c.wrap(helpOptionAction)(c) })
 		return
 	}
 
 	//	now we can check the result from parseOptions
-	if err != nil {
-		return
+	if err = c.check(err); err != nil {
+		return c.usageError(err)
 	}
 
-	err = c.validateOptions()
-	if err != nil {
+	return c.execute()
+}
+
+// check verifies the parsed command line against the declarations along the command path,
+// stopping at the first problem unless all errors are reported together.
+func (c *Context) check(parseErr error) error {
+	var errs flags.Errors
+	fail := func(err error) bool {
+		errs = appendErrors(errs, err)
+		return !c.app.CollectErrors
+	}
+	for _, err := range c.pathErrors {
+		if fail(err) {
+			return err
+		}
+	}
+	if parseErr != nil && fail(parseErr) {
+		return parseErr
+	}
+	if err := c.checkArgCount(); err != nil && fail(err) {
+		return err
+	}
+	if err := c.validateOptions(); err != nil && fail(err) {
 		return err
 	}
-
 	for _, cmd := range c.commands {
-		if cmd.Before != nil {
-			if err := cmd.Before(c); err != nil {
+		if cmd.Validate != nil {
+			if err := cmd.Validate(c); err != nil && fail(err) {
 				return err
 			}
 		}
 	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkArgCount verifies the number of free arguments, pointing at the first
+// excess one or at the end of the command line if some are missing.
+func (c *Context) checkArgCount() error {
+	count := c.Command().ArgCount
+	err := count.check(len(c.args))
+	if err == nil {
+		return nil
+	}
+	index := len(c.parsed)
+	if count.max >= 0 && len(c.args) > count.max {
+		index -= len(c.args) - count.max
+	}
+	return &flags.ArgError{Index: index, Err: err}
+}
+
+// execute runs the Before hooks down the command path, the action, and then
+// the After hooks of every command whose Before was reached, in reverse order.
+func (c *Context) execute() (err error) {
+	if timeout := c.timeout(); timeout > 0 {
+		parent := c.Context()
+		var cancel context.CancelFunc
+		c.ctx, cancel = context.WithTimeoutCause(parent, timeout, TimeoutError{timeout})
+		defer func() {
+			cancel()
+			c.ctx = parent
+		}()
+	}
+
+	reached := 0
+	for _, cmd := range c.commands {
+		reached++
+		if before := cmd.Before; before != nil {
+			if err = c.call(func() error { return before(c) }); err != nil {
+				break
+			}
+		}
+	}
 
 	if err == nil {
-		if c.Command().Action != nil {
-			err = c.Command().Action(c)
-		} else if len(c.Command().Commands) > 0 {
-			err = helpCommandAction(c)
+		action := c.Command().Action
+		if action == nil && len(c.Command().Commands) > 0 {
+			action = helpCommandAction
+		}
+		if action != nil {
+			err = c.call(func() error { return c.wrap(action)(c) })
+		}
+	}
+
+	var timeout TimeoutError
+	if errors.Is(err, context.DeadlineExceeded) && errors.As(context.Cause(c.Context()), &timeout) {
+		err = timeout
+	}
+
+	if parent := c.Context(); parent.Err() != nil {
+		var cancel context.CancelFunc
+		c.ctx, cancel = context.WithTimeout(context.WithoutCancel(parent), c.app.gracePeriod())
+		defer func() {
+			cancel()
+			c.ctx = parent
+		}()
+	}
+	for i := reached - 1; i >= 0; i-- {
+		if after := c.commands[i].After; after != nil {
+			prev := err
+			err = combineErrors(err, c.call(func() error { return after(c, prev) }))
 		}
 	}
 
 	return
+}
 
+// call runs a hook or an action, turning a panic into a PanicError if the app recovers panics.
+func (c *Context) call(fn func() error) (err error) {
+	if c.app.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return fn()
 }
 
 func (c *Context) setupOptions() {
 	if c.options == nil {
-		c.options = flags.NewSet()
+		c.options, c.named = c.optionSet(true)
+	}
+}
+
+// optionSet declares the options available to the last command of the path,
+// together with the positionals of the intermediate commands that took them.
+// The last command's own positionals are only declared if current is set.
+func (c *Context) optionSet(current bool) (set *flags.Set, named map[string]Option) {
+	set = flags.NewSet()
+	set.Repeat = c.app.RepeatPolicy
+	set.AllowDashArgs = c.Command().AllowDashArgs
+	set.CollectErrors = c.app.CollectErrors
+	set.Out = c.app.errWriter()
+	named = map[string]Option{}
+	options, positionals := c.declaredOptions(current)
+	for _, arg := range positionals {
+		arg.applyPositional(set, c.app.getenv)
+	}
+	options = append(options, HelpOption)
+	if c.app.EnableShellCompletion {
+		options = append(options, ShellCompletionOption)
+	}
+	for _, opt := range options {
+		opt.applyNamed(set, c.app.getenv)
+		eachName(opt.name(), func(name string) {
+			named[name] = opt
+		})
 	}
+	return
+}
+
+// declaredOptions lists the options declared along the command path that apply to its last command.
+func (c *Context) declaredOptions(current bool) (options, positionals []Option) {
 	for i, com := range c.commands {
-		for _, arg := range com.Args {
-			//	only the direct command may take a positional
-			if i == len(c.commands)-1 {
-				arg.ApplyPositional(c.options)
-			}
+		last := i == len(c.commands)-1
+		if (last && current) || (!last && i < len(c.argLevels) && c.argLevels[i]) {
+			positionals = append(positionals, com.Args...)
 		}
 		for _, opt := range com.Options {
 			//	local options are not inherited by subcommands
-			if i == len(c.commands)-1 || !opt.local() {
-				opt.ApplyNamed(c.options)
+			if last || !opt.local() {
+				options = append(options, opt)
 			}
 		}
 	}
-	HelpOption.ApplyNamed(c.options)
-	if c.app.EnableShellCompletion {
-		ShellCompletionOption.ApplyNamed(c.options)
+	if opt := timeoutOption(c.commands); opt != nil {
+		options = append(options, opt)
+	}
+	return
+}
+
+// pathTimeout is the Timeout of the last command in the path that declares one.
+func pathTimeout(commands []Command) (timeout time.Duration) {
+	for _, cmd := range commands {
+		if cmd.Timeout != 0 {
+			timeout = cmd.Timeout
+		}
 	}
+	return
+}
+
+// timeoutOption returns the built-in --timeout option if a command in the path exposes it.
+func timeoutOption(commands []Command) Option {
+	for _, cmd := range commands {
+		if cmd.TimeoutOption {
+			opt := TimeoutOption
+			if timeout := pathTimeout(commands); timeout != 0 {
+				opt.Value = timeout.String()
+			}
+			return opt
+		}
+	}
+	return nil
+}
+
+// timeout is the deadline for the command, from --timeout if it is exposed.
+func (c *Context) timeout() time.Duration {
+	if timeoutOption(c.commands) != nil {
+		timeout, _ := time.ParseDuration(c.String(firstName(TimeoutOption.Name)))
+		return timeout
+	}
+	return pathTimeout(c.commands)
 }
 
 func (c *Context) parseOptions() (err error) {
+	c.parsed = c.args
 	err = c.options.Parse(c.args)
+	walkErrors(err, func(err error) {
+		if repeated, ok := err.(*flags.RepeatedOptionError); ok {
+			repeated.FirstIndex, repeated.SecondIndex = c.position(repeated.FirstIndex), c.position(repeated.SecondIndex)
+		}
+	})
 	c.parseError = err
 	c.args = c.options.Args()
 	return
 }
 
 func (c *Context) validateOptions() error {
-	for _, opt := range c.Command().Options {
+	var errs flags.Errors
+	options, positionals := c.declaredOptions(true)
+	for _, opt := range append(options, positionals...) {
 		if opt.validation() != nil {
 			if err := opt.validation()(c, opt); err != nil {
-				return nil
+				if _, located := err.(*flags.ArgError); !located && !c.accumulates(opt) {
+					if i := c.options.Index(firstName(opt.name())); i >= 0 {
+						err = &flags.ArgError{Index: i, Err: err}
+					}
+				}
+				if !c.app.CollectErrors {
+					return err
+				}
+				errs = append(errs, err)
 			}
 		}
 	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-func (c *Context) findOption(name string) (option Option) {
-	for _, cmd := range c.commands {
-		for _, opt := range cmd.Args {
-			if opt.name() == name {
-				option = opt
-			}
+// optionValues returns the current values of an option, one per element for
+// accumulating options, and whether they are just the declared default,
+// given neither on the command line nor in the environment.
+func (c *Context) optionValues(opt Option) (values []string, isDefault bool) {
+	name := firstName(opt.name())
+	lowOpt := c.options.Lookup(name)
+	if lowOpt == nil {
+		return nil, true
+	}
+	isDefault = c.options.Index(name) < 0 && !lowOpt.FromEnv
+	if slice, ok := lowOpt.Value.(*StringSlice); ok {
+		return slice.Value(), isDefault
+	}
+	return []string{lowOpt.Value.String()}, isDefault
+}
+
+// accumulates reports whether the option collects a value per occurrence.
+func (c *Context) accumulates(opt Option) bool {
+	lowOpt := c.options.Lookup(firstName(opt.name()))
+	if lowOpt == nil {
+		return false
+	}
+	_, ok := lowOpt.Value.(*StringSlice)
+	return ok
+}
+
+// valueIndex returns the position in the parsed arguments of the argument holding
+// the given value of an option, or -1 if it cannot be told.
+func (c *Context) valueIndex(opt Option, value string) int {
+	name := firstName(opt.name())
+	if !c.accumulates(opt) {
+		return c.options.Index(name)
+	}
+	lowOpt := c.options.Lookup(name)
+	occurrences := c.options.Occurrences()
+	for i := len(occurrences) - 1; i >= 0; i-- {
+		occ := occurrences[i]
+		if occ.Option.Value == lowOpt.Value && !occ.Ignored && !occ.Negated && occ.Value == value {
+			return occ.ValueIndex
 		}
-		for _, opt := range cmd.Options {
-			if opt.name() == name {
-				option = opt
-			}
+	}
+	return -1
+}
+
+// displayName is the option's name as written on the command line, or in angle brackets for positionals.
+func (c *Context) displayName(opt Option) string {
+	name := firstName(opt.name())
+	if _, named := c.named[name]; named {
+		return prefixFor(name) + name
+	}
+	return "<" + name + ">"
+}
+
+// wrap applies the middleware of the app and of the command path to an action.
+func (c *Context) wrap(action func(*Context) error) func(*Context) error {
+	chain := append([]Middleware{}, c.app.Middleware...)
+	for _, cmd := range c.commands {
+		chain = append(chain, cmd.Middleware...)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		action = chain[i](action)
+	}
+	return action
+}
+
+// combineErrors merges the error returned by an After hook into the error so far.
+// The earlier error is kept unless the hook's error already wraps it.
+func combineErrors(err, afterErr error) error {
+	switch {
+	case afterErr == nil:
+		return err
+	case err == nil || errors.Is(afterErr, err):
+		return afterErr
+	default:
+		return errors.Join(err, afterErr)
+	}
+}
+
+// appendErrors adds err to errs, flattening lists of errors.
+func appendErrors(errs flags.Errors, err error) flags.Errors {
+	if list, ok := err.(flags.Errors); ok {
+		return append(errs, list...)
+	}
+	return append(errs, err)
+}
+
+// attachedOption returns the named option whose value is being completed as
+// the last argument in the form of --name=.
+func (c *Context) attachedOption() Option {
+	if len(c.parsed) == 0 {
+		return nil
+	}
+	last := c.parsed[len(c.parsed)-1]
+	if !strings.HasPrefix(last, "-") || !strings.HasSuffix(last, "=") {
+		return nil
+	}
+	name := strings.TrimLeft(last[:len(last)-1], "-")
+	if strings.Contains(name, "=") {
+		return nil
+	}
+	return c.named[name]
+}
+
+// findOption returns the option or positional declared for the command path under
+// the given name, including the built-in options, or nil.
+func (c *Context) findOption(name string) Option {
+	if opt, ok := c.named[name]; ok {
+		return opt
+	}
+	_, positionals := c.declaredOptions(true)
+	for _, arg := range positionals {
+		found := false
+		eachName(arg.name(), func(n string) {
+			found = found || n == name
+		})
+		if found {
+			return arg
 		}
 	}
-	return
+	return nil
 }
@@ -21,6 +21,8 @@ A minimally viable application looks like this:
 		a.RunMain()
 	}
 
+App.Validate reports mistakes in the command tree, such as duplicate subcommand names or options redeclared along a command path; a test can check the tree with cli.AssertValid(t, app).
+
 Named options
 
 Options can be used as follows:
@@ -66,6 +68,17 @@ Named options and positional arguments are declared and accessed through the sam
 	$ app value
 	> value
 
+Validation
+
+Options and positional arguments can declare a validation function; a failure stops the command before any Before hook runs.
+Validators for common rules can be combined:
+
+	cli.IntOption{
+		Name:       "replicas",
+		Value:      1,
+		Validation: cli.RangeValidation(1, 10),
+	}
+
 Subcommands
 
 Subcommands are created as follows:
@@ -85,6 +98,16 @@ Subcommands are created as follows:
 
 Like the root command Main, subcommands can have their own options and subcommands.
 
+Options inherited from parent commands can be given before, between or after subcommand names:
+
+	$ app --verbose cmd --flag value sub
+
+Cancellation
+
+Hooks and actions can observe cancellation through ctx.Context(). Under RunMain the context is cancelled on the first SIGINT or SIGTERM, and a second signal exits immediately with status 130; After hooks of a cancelled command get a fresh context limited by App.GracePeriod.
+
+A command can set a deadline with Timeout, and expose the built-in --timeout option to its subcommands with TimeoutOption; a command that runs out of time fails with a TimeoutError.
+
 Help
 
 The root command has an implicit "help" subcommand, showing usage instructions. For help on subcommands, it is invoked as "app help subcmd1 subcmd2 ...".
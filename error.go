@@ -1,5 +1,46 @@
 package cli
 
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/ulfurinn/cli/flags"
+)
+
+// Conventional exit codes used by DefaultExitCode.
+const (
+	ExitUsage       = 2   // command line usage error
+	ExitTimeout     = 124 // command timed out, as with timeout(1)
+	ExitPanic       = 70  // internal software error (EX_SOFTWARE)
+	ExitConfig      = 78  // configuration error (EX_CONFIG)
+	ExitInterrupted = 130 // terminated by SIGINT
+)
+
+// ErrInterrupted reports a command stopped by an interrupt signal.
+var ErrInterrupted = errors.New("interrupted")
+
+// TimeoutError reports a command that ran past the deadline set by Command.Timeout or --timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v", e.Timeout)
+}
+
+func (e TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Exit makes RunMain exit with the given status code; it may be wrapped by other errors.
+// An Exit without an error exits silently.
 type Exit struct {
 	Err        error
 	StatusCode int
@@ -15,3 +56,217 @@ func (e Exit) Error() string {
 	}
 	return ""
 }
+
+func (e Exit) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError reports invalid or missing configuration.
+type ConfigError struct {
+	Err error
+}
+
+func (e ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultExitCode maps an error returned from App.Run to a process exit status:
+// the status of an Exit anywhere in the chain, ExitPanic for a recovered panic,
+// ExitUsage for usage errors, ExitTimeout for a TimeoutError, ExitInterrupted
+// for ErrInterrupted, ExitConfig for a ConfigError, and 1 for anything else.
+func DefaultExitCode(err error) int {
+	var exit Exit
+	var panicErr PanicError
+	var usage UsageError
+	var config ConfigError
+	var timeout TimeoutError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exit):
+		return exit.StatusCode
+	case errors.As(err, &panicErr):
+		return ExitPanic
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.As(err, &timeout):
+		return ExitTimeout
+	case errors.Is(err, ErrInterrupted):
+		return ExitInterrupted
+	case errors.As(err, &config):
+		return ExitConfig
+	default:
+		return 1
+	}
+}
+
+// UsageError reports a command line that does not match the declaration of the command.
+type UsageError struct {
+	Command string // the full command name, starting with the application name
+	Hint    string // where to find usage instructions
+	Err     error
+	ctx     *Context
+}
+
+func (e UsageError) Error() string {
+	return e.Command + ": " + e.Err.Error()
+}
+
+func (e UsageError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is returned from App.Run in place of a panic in a Before, After or action
+// if the App recovers panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+func (e PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// ErrorFormat is a configurable presentation of errors returned from App.Run;
+// its Format method can be used as App.FormatError.
+type ErrorFormat struct {
+	AppName bool // prefix messages with the application name, unless they already name the command
+	Hint    bool // follow usage errors with a hint on getting help
+	Usage   bool // precede usage errors with the usage of the failing command
+	Color   bool // highlight messages if the error stream is a terminal and $NO_COLOR is not set
+	// CommandLine follows usage errors with the command line, marking the arguments that caused them.
+	CommandLine bool
+}
+
+func (f ErrorFormat) Format(app *App, err error) string {
+	msg := err.Error()
+	if msg == "" {
+		return ""
+	}
+	var usage UsageError
+	isUsage := errors.As(err, &usage)
+	if f.AppName && !isUsage && app.Name != "" {
+		msg = app.Name + ": " + msg
+	}
+	color := f.Color && isTerminal(app.errWriter()) && app.getenv("NO_COLOR") == ""
+	if color {
+		msg = "\x1b[31m" + msg + "\x1b[0m"
+	}
+	var panicErr PanicError
+	if errors.As(err, &panicErr) && app.debug() {
+		msg += "\n" + strings.TrimRight(string(panicErr.Stack), "\n")
+	}
+	if isUsage {
+		if f.CommandLine && usage.ctx != nil {
+			if line := usage.ctx.commandLine(err, color); line != "" {
+				msg += "\n" + line
+			}
+		}
+		if f.Hint && usage.Hint != "" {
+			msg += "\n" + usage.Hint
+		}
+		if f.Usage && usage.ctx != nil {
+			var b bytes.Buffer
+			writeHelp(&b, usage.ctx)
+			msg = strings.Trim(b.String(), "\n") + "\n\n" + msg
+		}
+	}
+	return msg
+}
+
+// commandLine renders the arguments passed to App.Run after the application name,
+// with a marker under each argument that caused err; it is empty if there are none.
+func (c *Context) commandLine(err error, color bool) string {
+	argErrs := argErrors(err)
+	if len(argErrs) == 0 {
+		return ""
+	}
+	tokens := []string{c.app.Name}
+	for _, arg := range c.argv {
+		tokens = append(tokens, quoteArg(arg))
+	}
+	marked := map[int]bool{}
+	for _, e := range argErrs {
+		i := len(c.argv)
+		if e.Index < len(c.parsed) {
+			i = c.position(e.Index)
+		}
+		marked[i+1] = true
+	}
+	red := func(s string) string {
+		if color {
+			return "\x1b[31m" + s + "\x1b[0m"
+		}
+		return s
+	}
+	var line, marker strings.Builder
+	for i, token := range tokens {
+		if i > 0 {
+			line.WriteString(" ")
+			marker.WriteString(" ")
+		}
+		if marked[i] {
+			line.WriteString(red(token))
+			marker.WriteString(red(strings.Repeat("^", len(token))))
+		} else {
+			line.WriteString(token)
+			marker.WriteString(strings.Repeat(" ", len(token)))
+		}
+	}
+	if marked[len(tokens)] {
+		marker.WriteString(" " + red("^"))
+	}
+	return "  " + line.String() + "\n  " + strings.TrimRight(marker.String(), " ")
+}
+
+// argErrors finds the errors attributed to particular arguments in an error tree.
+func argErrors(err error) (found []*flags.ArgError) {
+	walkErrors(err, func(err error) {
+		if argErr, ok := err.(*flags.ArgError); ok {
+			found = append(found, argErr)
+		}
+	})
+	return
+}
+
+// walkErrors calls fn for every error in an error tree, depth first.
+func walkErrors(err error, fn func(error)) {
+	if err == nil {
+		return
+	}
+	fn(err)
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			walkErrors(err, fn)
+		}
+	case interface{ Unwrap() error }:
+		walkErrors(e.Unwrap(), fn)
+	}
+}
+
+// quoteArg quotes an argument that would not read back as a single word.
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -14,20 +14,114 @@ type Value interface {
 	Explicit() bool
 }
 
+// Resetter is implemented by values that accumulate input, such as slices;
+// the negated form of a negatable option clears them instead of restoring the default.
+// Repeat policies do not apply to such values.
+type Resetter interface {
+	Reset()
+}
+
+// RepeatPolicy defines what happens when a single-valued option is given more than once.
+type RepeatPolicy int
+
+const (
+	RepeatDefault   RepeatPolicy = iota // defer to the set's policy; on the set itself, the same as RepeatLastWins
+	RepeatLastWins                      // the last occurrence overrides the previous ones
+	RepeatFirstWins                     // later occurrences are ignored
+	RepeatError                         // a repeated option is a parse error
+)
+
 type Option struct {
-	Name     string
-	Usage    string
-	Value    Value
-	Optional bool
-	Default  string
+	Name      string
+	Usage     string
+	Value     Value
+	Optional  bool
+	Default   string
+	Negatable bool // accept --no-<name>
+	Repeat    RepeatPolicy
+	// OptionalValue options take BareValue when given without '=' and never consume the next argument.
+	OptionalValue bool
+	BareValue     string
+	FromEnv       bool // Default was taken from the environment
+}
+
+// Occurrence records a single appearance of a named option on the command line.
+type Occurrence struct {
+	Option  *Option
+	Name    string // the name the option was given under
+	Value   string // the value the occurrence stands for, such as "true" for a bare bool or the default for a negated option; empty for negated accumulating values
+	Raw     string // the value as written; empty if none was given
+	Negated bool
+	Ignored bool // skipped under RepeatFirstWins
+	Index   int  // position of the option token in the parsed arguments
+	// ValueIndex is the position of the argument holding the value, which differs
+	// from Index when the value is given as a separate argument.
+	ValueIndex int
+}
+
+type occurrence struct {
+	token string
+	index int
 }
 
 type Set struct {
 	arguments        []*Option
 	declared, actual map[string]*Option
 	args             []string
+	seen             map[Value]occurrence
+	indices          map[Value]int
+	occurrences      []Occurrence
+	terminated       bool
 	MissingValue     *Option
 	Out              io.Writer
+	Repeat           RepeatPolicy // applies to options that do not declare their own
+	// AllowDashArgs makes unrecognised dash-prefixed tokens positional arguments instead of errors.
+	AllowDashArgs bool
+	// CollectErrors makes Parse carry on past errors and return all of them as Errors.
+	CollectErrors bool
+}
+
+// Errors is a list of problems found on a single command line.
+type Errors []error
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msg := fmt.Sprintf("%d errors:", len(e))
+	for _, err := range e {
+		msg += "\n  - " + err.Error()
+	}
+	return msg
+}
+
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// RepeatedOptionError reports an option given more than once under RepeatError.
+type RepeatedOptionError struct {
+	First, Second           string // the occurrences as written, with their values
+	FirstIndex, SecondIndex int    // positions of the occurrences in the parsed arguments
+}
+
+// Error numbers the arguments from 1.
+func (e *RepeatedOptionError) Error() string {
+	return fmt.Sprintf("option given more than once: %q at argument %d and %q at argument %d", e.First, e.FirstIndex+1, e.Second, e.SecondIndex+1)
+}
+
+// ArgError is a parse error caused by a particular argument.
+type ArgError struct {
+	Index int // position of the argument in the parsed list; the length of the list if one is missing at the end
+	Err   error
+}
+
+func (e *ArgError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ArgError) Unwrap() error {
+	return e.Err
 }
 
 func NewSet() *Set {
@@ -92,104 +186,243 @@ func isOption(s string) (option bool, name string) {
 	return
 }
 
-func (s *Set) Parse(args []string) (err error) {
-	var next string
+func (s *Set) Parse(args []string) error {
+	var errs Errors
+	fail := func(err error) bool {
+		errs = append(errs, err)
+		return !s.CollectErrors
+	}
 	s.args = args
 	if s.actual == nil {
 		s.actual = make(map[string]*Option)
 	}
+	s.seen = make(map[Value]occurrence)
+	s.indices = make(map[Value]int)
+	s.occurrences = nil
+	s.terminated = false
 	positional := s.arguments
 	for len(s.args) > 0 {
-		next = s.args[0]
+		next := s.args[0]
 		if next == "--" {
 			s.args = s.args[1:]
+			s.terminated = true
 			break
 		}
-		if option, name := isOption(next); option {
-			s.args = s.args[1:]
-			if name[0] == '-' || name[0] == '=' {
-				return fmt.Errorf("bad flag syntax: %s", next)
-			}
-			var value string
-			var opt *Option
-			var inverted bool
-			split := strings.Split(name, "=")
-			if len(split) == 1 {
-				opt = s.declared[name]
-				if opt == nil {
-					if strings.HasPrefix(name, "no-") {
-						name = name[3:]
-						opt = s.declared[name]
-						if opt == nil {
-							return fmt.Errorf("unknown argument --no-%s", name)
-						}
-						inverted = true
-					} else {
-						return fmt.Errorf("unknown argument --%s", name)
-					}
-				}
-				if len(s.args) > 0 {
-					switch opt.Value.(type) {
-					case *BoolValue:
-						if s.args[0] == "true" || s.args[0] == "false" {
-							value, s.args = s.args[0], s.args[1:]
-						} else {
-							if inverted {
-								value = "false"
-							} else {
-								value = "true"
-							}
-						}
-					default:
-						value, s.args = s.args[0], s.args[1:]
-					}
-				} else {
-					switch opt.Value.(type) {
-					case *BoolValue:
-						if inverted {
-							value = "false"
-						} else {
-							value = "true"
-						}
-					default:
-						s.MissingValue = opt
-						return fmt.Errorf("no value provided for argument --%s", name)
-					}
+		if option, name := isOption(next); option && !s.isValue(next, name, positional) {
+			index := len(args) - len(s.args)
+			if err := s.parseOption(index, next, name); err != nil {
+				if _, located := err.(*ArgError); !located {
+					err = &ArgError{index, err}
 				}
-			} else if len(split) == 2 {
-				name, value = split[0], split[1]
-				opt = s.declared[name]
-				if opt == nil {
-					return fmt.Errorf("unknown argument --%s", name)
+				if fail(err) {
+					return errs[0]
 				}
 			}
-			if err = opt.Value.Set(value); err != nil {
-				s.MissingValue = opt
-				return
-			}
-			s.actual[name] = opt
 		} else {
 			if len(positional) > 0 {
+				index := len(args) - len(s.args)
 				s.args = s.args[1:]
 				arg := positional[0]
-				if err = arg.Value.Set(next); err != nil {
-					return
-				}
 				positional = positional[1:]
+				if err := arg.Value.Set(next); err != nil {
+					if fail(&ArgError{index, fmt.Errorf("invalid value %q for argument %s: %w", next, arg.Name, err)}) {
+						return errs[0]
+					}
+				} else {
+					s.indices[arg.Value] = index
+				}
 			} else {
 				break // not an option and no more positionals
 			}
 		}
 	}
 	for _, opt := range positional {
-		s.MissingValue = positional[0]
-		if !opt.Optional {
-			return fmt.Errorf("no value provided for argument %s", s.MissingValue.Name)
+		if s.MissingValue == nil {
+			s.MissingValue = opt
 		}
+		if !opt.Optional && fail(&ArgError{len(args), fmt.Errorf("no value provided for argument %s", opt.Name)}) {
+			return errs[0]
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// parseOption handles the named option at the head of the remaining arguments.
+func (s *Set) parseOption(index int, next, name string) (err error) {
+	token := next
+	s.args = s.args[1:]
+	if name[0] == '-' || name[0] == '=' {
+		return fmt.Errorf("bad flag syntax: %s", next)
 	}
+	var value, raw string
+	var opt *Option
+	var inverted bool
+	valueIndex := index // position of the argument holding the value
+	if eq := strings.Index(name, "="); eq < 0 {
+		opt = s.declared[name]
+		if opt == nil {
+			if strings.HasPrefix(name, "no-") {
+				opt = s.declared[name[3:]]
+				if opt == nil || !opt.Negatable {
+					return fmt.Errorf("unknown argument --%s", name)
+				}
+				name = name[3:]
+				inverted = true
+			} else {
+				return fmt.Errorf("unknown argument --%s", name)
+			}
+		}
+		if inverted {
+			switch opt.Value.(type) {
+			case *BoolValue:
+				value = "false"
+			case Resetter:
+				// cleared instead of set
+			default:
+				value = opt.Default
+			}
+		} else if opt.OptionalValue {
+			value = opt.BareValue
+		} else if len(s.args) > 0 {
+			switch opt.Value.(type) {
+			case *BoolValue:
+				if s.args[0] == "true" || s.args[0] == "false" {
+					value, s.args = s.args[0], s.args[1:]
+					raw = value
+					token += " " + value
+					valueIndex++
+				} else {
+					value = "true"
+				}
+			default:
+				value, s.args = s.args[0], s.args[1:]
+				raw = value
+				token += " " + value
+				valueIndex++
+			}
+		} else {
+			switch opt.Value.(type) {
+			case *BoolValue:
+				value = "true"
+			default:
+				s.MissingValue = opt
+				return fmt.Errorf("no value provided for argument --%s", name)
+			}
+		}
+	} else {
+		name, value = name[:eq], name[eq+1:]
+		raw = value
+		opt = s.declared[name]
+		if opt == nil {
+			return fmt.Errorf("unknown argument --%s", name)
+		}
+	}
+	var apply bool
+	if apply, err = s.record(opt, token, index); err != nil {
+		return
+	}
+	s.occurrences = append(s.occurrences, Occurrence{Option: opt, Name: name, Value: value, Raw: raw, Negated: inverted, Ignored: !apply, Index: index, ValueIndex: valueIndex})
+	if !apply {
+		return
+	}
+	if r, ok := opt.Value.(Resetter); ok && inverted {
+		r.Reset()
+	} else if err = opt.Value.Set(value); err != nil {
+		s.MissingValue = opt
+		return &ArgError{valueIndex, fmt.Errorf("invalid value %q for argument --%s: %w", value, name, err)}
+	}
+	s.actual[name] = opt
+	s.indices[opt.Value] = valueIndex
 	return
 }
 
+// isValue reports whether a dash-prefixed token should be taken as a positional argument.
+func (s *Set) isValue(token, name string, positional []*Option) bool {
+	if s.known(name) {
+		return false
+	}
+	if s.AllowDashArgs {
+		return true
+	}
+	return len(positional) > 0 && isNumber(token)
+}
+
+// known reports whether name, possibly negated or with an attached value, refers to a declared option.
+func (s *Set) known(name string) bool {
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	if _, declared := s.declared[name]; declared {
+		return true
+	}
+	if strings.HasPrefix(name, "no-") {
+		opt := s.declared[name[3:]]
+		return opt != nil && opt.Negatable
+	}
+	return false
+}
+
+func isNumber(s string) bool {
+	if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return true
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// record notes an occurrence of a named option and reports whether its value should be applied.
+func (s *Set) record(opt *Option, token string, index int) (apply bool, err error) {
+	if _, multi := opt.Value.(Resetter); multi {
+		return true, nil
+	}
+	first, seen := s.seen[opt.Value]
+	if !seen {
+		s.seen[opt.Value] = occurrence{token, index}
+		return true, nil
+	}
+	policy := opt.Repeat
+	if policy == RepeatDefault {
+		policy = s.Repeat
+	}
+	switch policy {
+	case RepeatFirstWins:
+		return false, nil
+	case RepeatError:
+		return false, &RepeatedOptionError{first.token, token, first.index, index}
+	default:
+		return true, nil
+	}
+}
+
+// Occurrences returns the named options in the order they appeared in the last Parse,
+// including repetitions.
+func (s *Set) Occurrences() []Occurrence {
+	cp := make([]Occurrence, len(s.occurrences))
+	copy(cp, s.occurrences)
+	return cp
+}
+
+// Index returns the position in the parsed arguments of the argument holding the
+// value last set for the named option or positional, or -1 if it was not given.
+func (s *Set) Index(name string) int {
+	opt := s.declared[name]
+	if opt == nil {
+		return -1
+	}
+	if i, ok := s.indices[opt.Value]; ok {
+		return i
+	}
+	return -1
+}
+
+// Terminated reports whether the last Parse stopped at "--".
+func (s *Set) Terminated() bool {
+	return s.terminated
+}
+
 func (s *Set) Lookup(name string) *Option {
 	return s.declared[name]
 }
@@ -298,6 +531,7 @@ func (s *Set) BoolVar(target *bool, name string, value bool, usage string, posit
 		s.Argument(newBoolValue(target, value), name, usage, optional)
 	} else {
 		s.Var(newBoolValue(target, value), name, usage, optional)
+		s.declared[name].Negatable = true
 	}
 }
 
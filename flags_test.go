@@ -1,7 +1,10 @@
 package cli_test
 
 import (
+	"errors"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"testing"
 )
 import . "bitbucket.org/ulfurinn/cli/flags"
@@ -52,6 +55,31 @@ func TestOptionSet(t *testing.T) {
 				set.Parse([]string{"--option=value"})
 				So(s, ShouldEqual, "value")
 			})
+			Convey("Parse equal signs in values", func() {
+				var s string
+				set.StringVar(&s, "option", "defvalue", "", false, false)
+				err := set.Parse([]string{"--option=a=b"})
+				So(err, ShouldBeNil)
+				So(s, ShouldEqual, "a=b")
+			})
+			Convey("Parse explicitly empty values", func() {
+				var s string
+				set.StringVar(&s, "option", "defvalue", "", false, false)
+				err := set.Parse([]string{"--option=", "extra"})
+				So(err, ShouldBeNil)
+				So(s, ShouldEqual, "")
+				So(set.Arg(0), ShouldEqual, "extra")
+			})
+			Convey("Fail with an empty value that does not parse", func() {
+				set.Int("option", 42, "", nil, false)
+				err := set.Parse([]string{"--option="})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "--option")
+			})
+			Convey("Undeclared flag with equal signs", func() {
+				err := set.Parse([]string{"--option=a=b"})
+				So(err, ShouldNotBeNil)
+			})
 			Convey("Undeclared flag", func() {
 				var s string
 				set.StringVar(&s, "option", "defvalue", "", false, false)
@@ -136,6 +164,18 @@ func TestOptionSet(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(*s, ShouldBeFalse)
 			})
+			Convey("Explicit false value does not consume the next argument", func() {
+				s := set.Bool("option", true, "", nil, false)
+				err := set.Parse([]string{"--option=false", "true"})
+				So(err, ShouldBeNil)
+				So(*s, ShouldBeFalse)
+				So(set.Arg(0), ShouldEqual, "true")
+			})
+			Convey("Malformed explicit value", func() {
+				set.Bool("option", true, "", nil, false)
+				err := set.Parse([]string{"--option=maybe"})
+				So(err, ShouldNotBeNil)
+			})
 			Convey("Positive form", func() {
 				s := set.Bool("option", false, "", nil, false)
 				So(*s, ShouldBeFalse)
@@ -150,6 +190,179 @@ func TestOptionSet(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(*s, ShouldBeFalse)
 			})
+			Convey("Negative form does not consume a value", func() {
+				s := set.Bool("option", true, "", nil, false)
+				err := set.Parse([]string{"--no-option", "true"})
+				So(err, ShouldBeNil)
+				So(*s, ShouldBeFalse)
+				So(set.Arg(0), ShouldEqual, "true")
+			})
+			Convey("Negative form when negation is disabled", func() {
+				set.Bool("option", true, "", nil, false)
+				set.Lookup("option").Negatable = false
+				err := set.Parse([]string{"--no-option"})
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("Negating other values", func() {
+			Convey("Not negatable by default", func() {
+				set.String("option", "defvalue", "", nil, false)
+				err := set.Parse([]string{"--no-option"})
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Restores the default value", func() {
+				s := set.String("option", "defvalue", "", nil, false)
+				set.Lookup("option").Negatable = true
+				err := set.Parse([]string{"--option", "value", "--no-option"})
+				So(err, ShouldBeNil)
+				So(*s, ShouldEqual, "defvalue")
+			})
+		})
+
+		Convey("Repeated options", func() {
+			s := set.String("option", "defvalue", "", nil, false)
+			args := []string{"--option", "a", "--option=b"}
+			Convey("Last wins by default", func() {
+				So(set.Parse(args), ShouldBeNil)
+				So(*s, ShouldEqual, "b")
+			})
+			Convey("First wins", func() {
+				set.Lookup("option").Repeat = RepeatFirstWins
+				So(set.Parse(args), ShouldBeNil)
+				So(*s, ShouldEqual, "a")
+			})
+			Convey("Error", func() {
+				set.Repeat = RepeatError
+				err := set.Parse(args)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, `"--option a" at argument 1`)
+				So(err.Error(), ShouldContainSubstring, `"--option=b" at argument 3`)
+			})
+			Convey("Option policy overrides the set", func() {
+				set.Repeat = RepeatError
+				set.Lookup("option").Repeat = RepeatLastWins
+				So(set.Parse(args), ShouldBeNil)
+				So(*s, ShouldEqual, "b")
+			})
+		})
+
+		Convey("Recording occurrences", func() {
+			set.String("include", "", "", nil, false)
+			set.Bool("force", false, "", nil, false)
+			err := set.Parse([]string{"--include", "a", "--force", "--include=b", "--no-force"})
+			So(err, ShouldBeNil)
+			occ := set.Occurrences()
+			So(len(occ), ShouldEqual, 4)
+			So(occ[0].Name, ShouldEqual, "include")
+			So(occ[0].Value, ShouldEqual, "a")
+			So(occ[0].Index, ShouldEqual, 0)
+			So(occ[1].Name, ShouldEqual, "force")
+			So(occ[2].Value, ShouldEqual, "b")
+			So(occ[2].Index, ShouldEqual, 3)
+			So(occ[3].Negated, ShouldBeTrue)
+			So(occ[1].Value, ShouldEqual, "true")
+			So(occ[1].Raw, ShouldEqual, "")
+			So(occ[2].Raw, ShouldEqual, "b")
+		})
+
+		Convey("Recording ignored occurrences", func() {
+			set.Repeat = RepeatFirstWins
+			s := set.String("region", "", "", nil, false)
+			err := set.Parse([]string{"--region", "a", "--region=b"})
+			So(err, ShouldBeNil)
+			So(*s, ShouldEqual, "a")
+			occ := set.Occurrences()
+			So(len(occ), ShouldEqual, 2)
+			So(occ[0].Ignored, ShouldBeFalse)
+			So(occ[1].Ignored, ShouldBeTrue)
+			So(occ[1].Raw, ShouldEqual, "b")
+		})
+
+		Convey("Negative numbers", func() {
+			Convey("As option values", func() {
+				i := set.Int("offset", 0, "", nil, false)
+				So(set.Parse([]string{"--offset", "-3"}), ShouldBeNil)
+				So(*i, ShouldEqual, -3)
+			})
+			Convey("As pending positionals", func() {
+				i := set.IntArg("delta", 0, "", nil, false)
+				f := set.Float64Arg("factor", 0, "", nil, false)
+				So(set.Parse([]string{"-5", "-0.5"}), ShouldBeNil)
+				So(*i, ShouldEqual, -5)
+				So(*f, ShouldEqual, -0.5)
+			})
+			Convey("Declared options take precedence", func() {
+				set.IntArg("delta", 0, "", nil, false)
+				b := set.Bool("5", false, "", nil, false)
+				So(set.Parse([]string{"-5", "1"}), ShouldBeNil)
+				So(*b, ShouldBeTrue)
+			})
+			Convey("Not without a pending positional", func() {
+				So(set.Parse([]string{"-5"}), ShouldNotBeNil)
+			})
+		})
+
+		Convey("Allowing dash arguments", func() {
+			set.AllowDashArgs = true
+			b := set.Bool("force", false, "", nil, false)
+			So(set.Parse([]string{"--force", "-la", "--force"}), ShouldBeNil)
+			So(*b, ShouldBeTrue)
+			So(set.Args(), ShouldResemble, []string{"-la", "--force"})
+		})
+
+		Convey("Optional values", func() {
+			s := set.String("color", "auto", "", nil, false)
+			set.Lookup("color").OptionalValue = true
+			set.Lookup("color").BareValue = "always"
+			Convey("Bare", func() {
+				So(set.Parse([]string{"--color", "never"}), ShouldBeNil)
+				So(*s, ShouldEqual, "always")
+				So(set.Arg(0), ShouldEqual, "never")
+			})
+			Convey("Attached", func() {
+				So(set.Parse([]string{"--color=never"}), ShouldBeNil)
+				So(*s, ShouldEqual, "never")
+			})
+			Convey("Absent", func() {
+				So(set.Parse([]string{}), ShouldBeNil)
+				So(*s, ShouldEqual, "auto")
+			})
+		})
+
+		Convey("Collecting errors", func() {
+			set.CollectErrors = true
+			set.Int("int", 0, "", nil, false)
+			s := set.String("str", "", "", nil, false)
+			set.StringArg("arg", "", "", nil, false)
+			err := set.Parse([]string{"--unknown", "--int", "x", "--str", "value"})
+			So(err, ShouldNotBeNil)
+			var errs Errors
+			So(errors.As(err, &errs), ShouldBeTrue)
+			So(len(errs), ShouldEqual, 3)
+			So(err.Error(), ShouldEqual, "3 errors:\n"+
+				"  - unknown argument --unknown\n"+
+				"  - invalid value \"x\" for argument --int: strconv.ParseInt: parsing \"x\": invalid syntax\n"+
+				"  - no value provided for argument arg")
+			So(errors.Is(err, strconv.ErrSyntax), ShouldBeTrue)
+			So(*s, ShouldEqual, "value")
+		})
+
+		Convey("Locating errors", func() {
+			set.CollectErrors = true
+			set.Int("int", 0, "", nil, false)
+			set.String("str", "", "", nil, false)
+			set.StringArg("arg", "", "", nil, false)
+			err := set.Parse([]string{"--str", "a", "--int", "x", "--unknown"})
+			var indexes []int
+			for _, e := range err.(Errors) {
+				var argErr *ArgError
+				So(errors.As(e, &argErr), ShouldBeTrue)
+				indexes = append(indexes, argErr.Index)
+			}
+			So(indexes, ShouldResemble, []int{3, 4, 5})
+			So(set.Index("str"), ShouldEqual, 1)
+			So(set.Index("int"), ShouldEqual, -1)
 		})
 
 		Convey("Should record the last flag without a value", func() {
@@ -162,3 +375,84 @@ func TestOptionSet(t *testing.T) {
 
 	})
 }
+
+func fuzzSet() *Set {
+	set := NewSet()
+	set.Out = ioutil.Discard
+	set.String("str", "", "", nil, false)
+	set.Int("int", 0, "", nil, false)
+	set.Float64("float", 0, "", nil, false)
+	set.Bool("bool", false, "", nil, false)
+	set.StringArg("arg", "", "", nil, true)
+	return set
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"--str=a=b",
+		"--str=",
+		"--bool=false extra",
+		"--no-bool --int -3",
+		"--float=1e3 -- --str",
+		"--=x -=",
+		"--no-str=x ---",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		set := fuzzSet()
+		args := strings.Fields(line)
+		if err := set.Parse(args); err != nil {
+			return
+		}
+		rest := set.Args()
+		consumed := len(args) - len(rest)
+		if consumed < 0 || strings.Join(args[consumed:], "\x00") != strings.Join(rest, "\x00") {
+			t.Fatalf("leftover arguments %q are not a suffix of %q", rest, args)
+		}
+		// every consumed argument is an option, its value, the positional or the final "--"
+		accounted := map[int]bool{}
+		if set.Terminated() {
+			accounted[consumed-1] = true
+		}
+		if i := set.Index("arg"); i >= 0 {
+			accounted[i] = true
+		}
+		str := ""
+		for _, occ := range set.Occurrences() {
+			accounted[occ.Index] = true
+			token := args[occ.Index]
+			if eq := strings.Index(token, "="); eq >= 0 {
+				if occ.Raw != token[eq+1:] {
+					t.Errorf("%q recorded as %q", token, occ.Raw)
+				}
+			} else if occ.Raw != "" {
+				accounted[occ.Index+1] = true
+			}
+			if occ.Name == "str" && !occ.Ignored {
+				str = occ.Value
+			}
+		}
+		if len(accounted) != consumed {
+			t.Errorf("accounted for %d of %d consumed arguments in %q", len(accounted), consumed, args)
+		}
+		if got := set.Lookup("str").Value.String(); got != str {
+			t.Errorf("str is %q, last given as %q in %q", got, str, args)
+		}
+	})
+}
+
+func FuzzParseAttachedValue(f *testing.F) {
+	for _, seed := range []string{"", "a", "a=b", "=", "==", "--str", "-1"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		set := fuzzSet()
+		if err := set.Parse([]string{"--str=" + value}); err != nil {
+			t.Fatalf("parsing %q: %v", value, err)
+		}
+		if got := set.Lookup("str").Value.String(); got != value {
+			t.Errorf("expected %q, got %q", value, got)
+		}
+	})
+}
@@ -1,15 +1,18 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"sort"
 	"strings"
+	"time"
 
 	"text/template"
 )
 
 var tplSource = `
-Usage: {{.AppName}}{{.CommandList}}{{range .Args}} <{{.Name}}>{{end}}{{if .Usage}}
+Usage: {{.AppName}}{{.CommandList}}{{range .Args}} <{{.Name}}>{{end}}{{.ArgCount}}{{if .Usage}}
 
 {{.Usage}}{{end}}{{if .Subcommands}}
 
@@ -31,6 +34,7 @@ type helpOption struct {
 type helpContext struct {
 	AppName     string
 	CommandList string
+	ArgCount    string
 	Usage       string
 	Subcommands []struct {
 		Name  string
@@ -42,8 +46,22 @@ type helpContext struct {
 
 // This flag prints the help for all commands and subcommands
 var HelpOption = BoolOption{
-	Name:  "help, h",
-	Usage: "show help",
+	Name:            "help, h",
+	Usage:           "show help",
+	DisableNegation: true,
+}
+
+// TimeoutOption is the built-in option overriding the deadline of commands that expose it;
+// its default is the Timeout of the command, and 0 disables the deadline.
+var TimeoutOption = StringOption{
+	Name:  "timeout",
+	Usage: "abort the command after this duration, 0 for no limit",
+	Validation: CombineValidation(DurationValidation, EachValueValidation(func(value string) error {
+		if d, _ := time.ParseDuration(value); d < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	})),
 }
 
 var HelpCommand Command
@@ -65,11 +83,11 @@ func helpCommandAction(ctx *Context) error {
 	tpl, _ := template.New("help").Parse(tplSource)
 	helpCtx := helpContext{}
 	helpCtx.setupCommand(ctx)
-	return tpl.Execute(ctx.app.Out, helpCtx)
+	return tpl.Execute(ctx.app.outWriter(), helpCtx)
 }
 
 func helpTreeCommandAction(ctx *Context) error {
-	expanded := ctx.app.Main.expanded()
+	expanded := ctx.commands[0].expanded()
 	names := []string{}
 	longest := 0
 	for cmd := range expanded {
@@ -89,20 +107,25 @@ func helpTreeCommandAction(ctx *Context) error {
 		}
 		prefix := ctx.app.Name + cmd
 		padding := longest - len(prefix) + 2
-		fmt.Print(prefix)
+		fmt.Fprint(ctx.app.outWriter(), prefix)
 		for i := 0; i < padding; i++ {
-			fmt.Print(" ")
+			fmt.Fprint(ctx.app.outWriter(), " ")
 		}
-		fmt.Println("#", expanded[cmd].Usage)
+		fmt.Fprintln(ctx.app.outWriter(), "#", expanded[cmd].Usage)
 	}
 	return nil
 }
 
 func helpOptionAction(ctx *Context) error {
+	return writeHelp(ctx.app.outWriter(), ctx)
+}
+
+// writeHelp renders the help of the last command in the context's path.
+func writeHelp(out io.Writer, ctx *Context) error {
 	tpl, _ := template.New("help").Parse(tplSource)
 	helpCtx := helpContext{}
 	helpCtx.setup(ctx)
-	return tpl.Execute(ctx.app.Out, helpCtx)
+	return tpl.Execute(out, helpCtx)
 }
 
 func (h *helpContext) setupCommand(ctx *Context) {
@@ -110,7 +133,7 @@ func (h *helpContext) setupCommand(ctx *Context) {
 		app:  ctx.app,
 		args: ctx.args,
 	}
-	ctx.app.Main.FindCommand(subctx)
+	ctx.commands[0].FindCommand(subctx)
 	h.setup(subctx)
 }
 
@@ -122,16 +145,21 @@ func (h *helpContext) setup(ctx *Context) {
 	}
 	cmdPath := []string{}
 	for i, cmd := range usedCommands {
-		if i == 0 {
-			continue
+		if i > 0 {
+			cmdPath = append(cmdPath, cmd.Name)
+		}
+		if i < len(usedCommands)-1 {
+			for _, arg := range cmd.Args {
+				cmdPath = append(cmdPath, "<"+firstName(arg.name())+">")
+			}
 		}
-		cmdPath = append(cmdPath, cmd.Name)
 	}
 	if len(cmdPath) > 0 {
 		h.CommandList = " " + strings.Join(cmdPath, " ")
 	}
 	activeCommand := usedCommands[len(usedCommands)-1]
 	h.Usage = activeCommand.Usage
+	h.ArgCount = activeCommand.ArgCount.usage()
 	maxSubLength := 0
 	maxOptLength := 0
 	for _, cmd := range activeCommand.Commands {
@@ -147,10 +175,13 @@ func (h *helpContext) setup(ctx *Context) {
 	for i, cmd := range usedCommands {
 		for _, opt := range cmd.Options {
 			if !opt.local() || i == len(usedCommands)-1 {
-				opts[opt.name()] = helpOption{"--" + opt.name(), opt.usage()}
+				opts[opt.name()] = helpOption{helpName(opt), opt.usage()}
 			}
 		}
 	}
+	if opt := timeoutOption(usedCommands); opt != nil {
+		opts[opt.name()] = helpOption{helpName(opt), opt.usage()}
+	}
 	optKeys := []string{}
 	for k := range opts {
 		optKeys = append(optKeys, k)
@@ -181,7 +212,7 @@ func helpCompletion(ctx *Context) {
 		app:  ctx.app,
 		args: ctx.args,
 	}
-	subctx.app.Main.FindCommand(subctx)
+	ctx.commands[0].FindCommand(subctx)
 	cmd := subctx.Command()
 	subctx.setupOptions()
 	cmd.showCompletion(subctx)
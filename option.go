@@ -34,7 +34,11 @@ type Option interface {
 	// Apply Option settings to the given flag set
 	ApplyNamed(*flags.Set)
 	ApplyPositional(*flags.Set)
+	// ApplyNamed and ApplyPositional with environment variables looked up through getenv
+	applyNamed(set *flags.Set, getenv func(string) string)
+	applyPositional(set *flags.Set, getenv func(string) string)
 	local() bool
+	optional() bool
 	name() string
 	usage() string
 	completion() completionFunc
@@ -111,6 +115,8 @@ func (f *StringSlice) Value() []string {
 
 func (f *StringSlice) Explicit() bool { return true }
 
+func (f *StringSlice) Reset() { *f = (*f)[:0] }
+
 type StringSliceOption struct {
 	Name       string
 	Value      *StringSlice
@@ -119,14 +125,15 @@ type StringSliceOption struct {
 	Hidden     bool
 	Optional   bool
 	Local      bool
+	Negatable  bool // --no-<name> clears the accumulated values
 	Completion completionFunc
 	Validation validationFunc
 }
 
 func (f StringSliceOption) String() string {
-	firstName := strings.Trim(strings.Split(f.Name, ",")[0], " ")
-	pref := prefixFor(firstName)
-	return withEnvHint(f.EnvVar, fmt.Sprintf("%s '%v'\t%v", prefixedNames(f.Name), pref+firstName+" option "+pref+firstName+" option", f.Usage))
+	first := firstName(f.Name)
+	pref := prefixFor(first)
+	return withEnvHint(f.EnvVar, fmt.Sprintf("%s '%v'\t%v", prefixedNames(f.Name), pref+first+" option "+pref+first+" option", f.Usage))
 }
 
 func (f StringSliceOption) HelpString() string {
@@ -143,32 +150,43 @@ func (f StringSliceOption) HelpString() string {
 }
 
 func (f StringSliceOption) CompletionStrings() []string {
-	return []string{prefixedNames(f.Name)}
+	return completionNames(f.Name, f.Negatable)
 }
 
-func (f StringSliceOption) ApplyNamed(set *flags.Set) {
+func (f StringSliceOption) ApplyNamed(set *flags.Set) { f.applyNamed(set, os.Getenv) }
+
+func (f StringSliceOption) applyNamed(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	f.Value = new(StringSlice)
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
+		if envVal := getenv(f.EnvVar); envVal != "" {
 			f.Value.Set(envVal)
+			fromEnv = true
 		}
 	}
 
 	eachName(f.Name, func(name string) {
 		set.Var(f.Value, name, f.Usage, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
+		set.Lookup(name).Negatable = f.Negatable
 	})
 }
 
-func (f StringSliceOption) ApplyPositional(set *flags.Set) {
+func (f StringSliceOption) ApplyPositional(set *flags.Set) { f.applyPositional(set, os.Getenv) }
+
+func (f StringSliceOption) applyPositional(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	f.Value = new(StringSlice)
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
+		if envVal := getenv(f.EnvVar); envVal != "" {
 			f.Value.Set(envVal)
+			fromEnv = true
 		}
 	}
 
 	eachName(f.Name, func(name string) {
 		set.Argument(f.Value, name, f.Usage, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
 	})
 }
 
@@ -186,6 +204,7 @@ func (f StringSliceOption) usage() string {
 
 func (f StringSliceOption) visible() bool              { return !f.Hidden }
 func (f StringSliceOption) local() bool                { return f.Local }
+func (f StringSliceOption) optional() bool             { return f.Optional }
 func (f StringSliceOption) completion() completionFunc { return f.Completion }
 func (f StringSliceOption) validation() validationFunc { return f.Validation }
 
@@ -250,14 +269,17 @@ func (f StringSliceOption) validation() validationFunc { return f.Validation }
 // func (f IntSliceOption) visible() bool { return !f.Hidden }
 
 type BoolOption struct {
-	Name     string
-	Value    bool
-	Usage    string
-	EnvVar   string
-	Hidden   bool
-	Var      *bool
-	Optional bool
-	Local    bool
+	Name            string
+	Value           bool
+	Usage           string
+	EnvVar          string
+	Hidden          bool
+	Var             *bool
+	Optional        bool
+	Local           bool
+	DisableNegation bool // do not accept --no-<name>
+	Repeat          flags.RepeatPolicy
+	Validation      validationFunc
 }
 
 func (f BoolOption) HelpString() string {
@@ -265,36 +287,52 @@ func (f BoolOption) HelpString() string {
 }
 
 func (f BoolOption) CompletionStrings() []string {
-	return []string{prefixedNames(f.Name), "--no-" + f.Name}
+	return completionNames(f.Name, !f.DisableNegation)
 }
 
-func (f BoolOption) ApplyNamed(set *flags.Set) {
+func (f BoolOption) ApplyNamed(set *flags.Set) { f.applyNamed(set, os.Getenv) }
+
+func (f BoolOption) applyNamed(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
+		if envVal := getenv(f.EnvVar); envVal != "" {
 			envValBool, err := strconv.ParseBool(envVal)
 			if err == nil {
 				f.Value = envValBool
+				fromEnv = true
 			}
 		}
 	}
 
+	if f.Var == nil {
+		f.Var = new(bool) // shared by all names of the option
+	}
+
 	eachName(f.Name, func(name string) {
 		set.Bool(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
+		set.Lookup(name).Negatable = !f.DisableNegation
+		set.Lookup(name).Repeat = f.Repeat
 	})
 }
 
-func (f BoolOption) ApplyPositional(set *flags.Set) {
+func (f BoolOption) ApplyPositional(set *flags.Set) { f.applyPositional(set, os.Getenv) }
+
+func (f BoolOption) applyPositional(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
+		if envVal := getenv(f.EnvVar); envVal != "" {
 			envValBool, err := strconv.ParseBool(envVal)
 			if err == nil {
 				f.Value = envValBool
+				fromEnv = true
 			}
 		}
 	}
 
 	eachName(f.Name, func(name string) {
 		set.BoolArg(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
 	})
 }
 
@@ -312,8 +350,9 @@ func (f BoolOption) usage() string {
 
 func (f BoolOption) visible() bool              { return !f.Hidden }
 func (f BoolOption) local() bool                { return f.Local }
+func (f BoolOption) optional() bool             { return f.Optional }
 func (f BoolOption) completion() completionFunc { return nil }
-func (f BoolOption) validation() validationFunc { return nil }
+func (f BoolOption) validation() validationFunc { return f.Validation }
 
 type StringOption struct {
 	Name       string
@@ -325,8 +364,15 @@ type StringOption struct {
 	Var        *string
 	Optional   bool
 	Local      bool
+	Negatable  bool // --no-<name> restores the default value
+	Repeat     flags.RepeatPolicy
 	Completion completionFunc
 	Validation validationFunc
+	// OptionalValue makes the option take BareValue when given as --name and
+	// accept a value only when attached as --name=value.
+	OptionalValue bool
+	BareValue     string
+	ValueName     string // shown in help as --name[=VALUE]
 }
 
 func (f StringOption) HelpString() string {
@@ -343,30 +389,48 @@ func (f StringOption) HelpString() string {
 }
 
 func (f StringOption) CompletionStrings() []string {
-	return []string{prefixedNames(f.Name)}
+	return completionNames(f.Name, f.Negatable)
 }
 
-func (f StringOption) ApplyNamed(set *flags.Set) {
+func (f StringOption) ApplyNamed(set *flags.Set) { f.applyNamed(set, os.Getenv) }
+
+func (f StringOption) applyNamed(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
+		if envVal := getenv(f.EnvVar); envVal != "" {
 			f.Value = envVal
+			fromEnv = true
 		}
 	}
 
+	if f.Var == nil {
+		f.Var = new(string) // shared by all names of the option
+	}
+
 	eachName(f.Name, func(name string) {
 		set.String(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
+		set.Lookup(name).Negatable = f.Negatable
+		set.Lookup(name).Repeat = f.Repeat
+		set.Lookup(name).OptionalValue = f.OptionalValue
+		set.Lookup(name).BareValue = f.BareValue
 	})
 }
 
-func (f StringOption) ApplyPositional(set *flags.Set) {
+func (f StringOption) ApplyPositional(set *flags.Set) { f.applyPositional(set, os.Getenv) }
+
+func (f StringOption) applyPositional(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
+		if envVal := getenv(f.EnvVar); envVal != "" {
 			f.Value = envVal
+			fromEnv = true
 		}
 	}
 
 	eachName(f.Name, func(name string) {
 		set.StringArg(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
 	})
 }
 
@@ -384,6 +448,7 @@ func (f StringOption) usage() string {
 
 func (f StringOption) visible() bool              { return !f.Hidden }
 func (f StringOption) local() bool                { return f.Local }
+func (f StringOption) optional() bool             { return f.Optional }
 func (f StringOption) completion() completionFunc { return f.Completion }
 func (f StringOption) validation() validationFunc { return f.Validation }
 
@@ -395,7 +460,10 @@ type IntOption struct {
 	Var        *int
 	Optional   bool
 	Local      bool
+	Negatable  bool // --no-<name> restores the default value
+	Repeat     flags.RepeatPolicy
 	Completion completionFunc
+	Validation validationFunc
 }
 
 func (f IntOption) HelpString() string {
@@ -403,36 +471,52 @@ func (f IntOption) HelpString() string {
 }
 
 func (f IntOption) CompletionStrings() []string {
-	return []string{prefixedNames(f.Name)}
+	return completionNames(f.Name, f.Negatable)
 }
 
-func (f IntOption) ApplyNamed(set *flags.Set) {
+func (f IntOption) ApplyNamed(set *flags.Set) { f.applyNamed(set, os.Getenv) }
+
+func (f IntOption) applyNamed(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
-			envValInt, err := strconv.ParseUint(envVal, 10, 64)
+		if envVal := getenv(f.EnvVar); envVal != "" {
+			envValInt, err := strconv.ParseInt(envVal, 0, 64)
 			if err == nil {
 				f.Value = int(envValInt)
+				fromEnv = true
 			}
 		}
 	}
 
+	if f.Var == nil {
+		f.Var = new(int) // shared by all names of the option
+	}
+
 	eachName(f.Name, func(name string) {
 		set.Int(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
+		set.Lookup(name).Negatable = f.Negatable
+		set.Lookup(name).Repeat = f.Repeat
 	})
 }
 
-func (f IntOption) ApplyPositional(set *flags.Set) {
+func (f IntOption) ApplyPositional(set *flags.Set) { f.applyPositional(set, os.Getenv) }
+
+func (f IntOption) applyPositional(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
-			envValInt, err := strconv.ParseUint(envVal, 10, 64)
+		if envVal := getenv(f.EnvVar); envVal != "" {
+			envValInt, err := strconv.ParseInt(envVal, 0, 64)
 			if err == nil {
 				f.Value = int(envValInt)
+				fromEnv = true
 			}
 		}
 	}
 
 	eachName(f.Name, func(name string) {
 		set.IntArg(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
 	})
 }
 
@@ -449,8 +533,9 @@ func (f IntOption) usage() string {
 }
 
 func (f IntOption) local() bool                { return f.Local }
+func (f IntOption) optional() bool             { return f.Optional }
 func (f IntOption) completion() completionFunc { return f.Completion }
-func (f IntOption) validation() validationFunc { return nil }
+func (f IntOption) validation() validationFunc { return f.Validation }
 
 // type DurationOption struct {
 // 	Name   string
@@ -490,7 +575,10 @@ type Float64Option struct {
 	Var        *float64
 	Optional   bool
 	Local      bool
+	Negatable  bool // --no-<name> restores the default value
+	Repeat     flags.RepeatPolicy
 	Completion completionFunc
+	Validation validationFunc
 }
 
 func (f Float64Option) HelpString() string {
@@ -498,36 +586,52 @@ func (f Float64Option) HelpString() string {
 }
 
 func (f Float64Option) CompletionStrings() []string {
-	return []string{prefixedNames(f.Name)}
+	return completionNames(f.Name, f.Negatable)
 }
 
-func (f Float64Option) ApplyNamed(set *flags.Set) {
+func (f Float64Option) ApplyNamed(set *flags.Set) { f.applyNamed(set, os.Getenv) }
+
+func (f Float64Option) applyNamed(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
-			envValFloat, err := strconv.ParseFloat(envVal, 10)
+		if envVal := getenv(f.EnvVar); envVal != "" {
+			envValFloat, err := strconv.ParseFloat(envVal, 64)
 			if err == nil {
 				f.Value = float64(envValFloat)
+				fromEnv = true
 			}
 		}
 	}
 
+	if f.Var == nil {
+		f.Var = new(float64) // shared by all names of the option
+	}
+
 	eachName(f.Name, func(name string) {
 		set.Float64(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
+		set.Lookup(name).Negatable = f.Negatable
+		set.Lookup(name).Repeat = f.Repeat
 	})
 }
 
-func (f Float64Option) ApplyPositional(set *flags.Set) {
+func (f Float64Option) ApplyPositional(set *flags.Set) { f.applyPositional(set, os.Getenv) }
+
+func (f Float64Option) applyPositional(set *flags.Set, getenv func(string) string) {
+	fromEnv := false
 	if f.EnvVar != "" {
-		if envVal := os.Getenv(f.EnvVar); envVal != "" {
-			envValFloat, err := strconv.ParseFloat(envVal, 10)
+		if envVal := getenv(f.EnvVar); envVal != "" {
+			envValFloat, err := strconv.ParseFloat(envVal, 64)
 			if err == nil {
 				f.Value = float64(envValFloat)
+				fromEnv = true
 			}
 		}
 	}
 
 	eachName(f.Name, func(name string) {
 		set.Float64Arg(name, f.Value, f.Usage, f.Var, f.Optional)
+		set.Lookup(name).FromEnv = fromEnv
 	})
 }
 
@@ -544,8 +648,26 @@ func (f Float64Option) usage() string {
 }
 
 func (f Float64Option) local() bool                { return f.Local }
+func (f Float64Option) optional() bool             { return f.Optional }
 func (f Float64Option) completion() completionFunc { return f.Completion }
-func (f Float64Option) validation() validationFunc { return nil }
+func (f Float64Option) validation() validationFunc { return f.Validation }
+
+// helpName is the option's name as shown in help, with the value placeholder of options with optional values.
+func helpName(opt Option) string {
+	name := "--" + opt.name()
+	if o, ok := opt.(StringOption); ok && o.OptionalValue {
+		valueName := o.ValueName
+		if valueName == "" {
+			valueName = "VALUE"
+		}
+		name += "[=" + valueName + "]"
+	}
+	return name
+}
+
+func firstName(fullName string) string {
+	return strings.Trim(strings.Split(fullName, ",")[0], " ")
+}
 
 func prefixFor(name string) (prefix string) {
 	if len(name) == 1 {
@@ -569,6 +691,22 @@ func prefixedNames(fullName string) (prefixed string) {
 	return
 }
 
+// completionNames lists every name of an option separately, followed by the
+// negated forms of its long names if the option accepts them.
+func completionNames(fullName string, negatable bool) (names []string) {
+	eachName(fullName, func(name string) {
+		names = append(names, prefixFor(name)+name)
+	})
+	if negatable {
+		eachName(fullName, func(name string) {
+			if len(name) > 1 {
+				names = append(names, "--no-"+name)
+			}
+		})
+	}
+	return
+}
+
 func withEnvHint(envVar, str string) string {
 	envText := ""
 	if envVar != "" {
@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/ulfurinn/cli/flags"
+)
+
+// CombineValidation runs several validation functions in order, reporting the first failure.
+func CombineValidation(fns ...func(*Context, Option) error) func(*Context, Option) error {
+	return func(ctx *Context, opt Option) error {
+		for _, fn := range fns {
+			if err := fn(ctx, opt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// EachValueValidation applies check to every value of an option, naming the option
+// and the offending value on failure. Declared defaults always pass; values given
+// on the command line or in the environment are checked.
+func EachValueValidation(check func(string) error) func(*Context, Option) error {
+	return func(ctx *Context, opt Option) error {
+		values, isDefault := ctx.optionValues(opt)
+		if isDefault {
+			return nil
+		}
+		for _, value := range values {
+			if err := check(value); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, ctx.displayName(opt), err)
+				if i := ctx.valueIndex(opt, value); i >= 0 {
+					err = &flags.ArgError{Index: i, Err: err}
+				}
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// NonEmptyValidation requires a non-empty value, including when the option is left at its default.
+func NonEmptyValidation(ctx *Context, opt Option) error {
+	values, _ := ctx.optionValues(opt)
+	for _, value := range values {
+		if value != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must not be empty", ctx.displayName(opt))
+}
+
+func OneOfValidation(allowed ...string) func(*Context, Option) error {
+	return EachValueValidation(func(value string) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(allowed, ", "))
+	})
+}
+
+// PatternValidation requires values to match a regular expression; it panics if the expression does not compile.
+func PatternValidation(pattern string) func(*Context, Option) error {
+	re := regexp.MustCompile(pattern)
+	return EachValueValidation(func(value string) error {
+		if !re.MatchString(value) {
+			return fmt.Errorf("must match %s", pattern)
+		}
+		return nil
+	})
+}
+
+func MinValidation(min float64) func(*Context, Option) error {
+	return EachValueValidation(func(value string) error {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if n < min {
+			return fmt.Errorf("must be at least %v", min)
+		}
+		return nil
+	})
+}
+
+func MaxValidation(max float64) func(*Context, Option) error {
+	return EachValueValidation(func(value string) error {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if n > max {
+			return fmt.Errorf("must be at most %v", max)
+		}
+		return nil
+	})
+}
+
+func RangeValidation(min, max float64) func(*Context, Option) error {
+	return CombineValidation(MinValidation(min), MaxValidation(max))
+}
+
+// DurationValidation requires values in the format accepted by time.ParseDuration.
+func DurationValidation(ctx *Context, opt Option) error {
+	return EachValueValidation(func(value string) error {
+		if value == "" {
+			return nil
+		}
+		_, err := time.ParseDuration(value)
+		return err
+	})(ctx, opt)
+}